@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"internal/config"
+	"internal/storage"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/rs/zerolog"
+)
+
+// служебные команды, передаются после флагов: gophermart -d=<dsn> repair-balances
+const (
+	COMMAND_REPAIR_BALANCES = "repair-balances"
+	COMMAND_MIGRATE         = "migrate"
+)
+
+// runCommand выполняет служебную команду вместо запуска сервера
+func runCommand(cfg config.ServerConfig, logger zerolog.Logger, args []string) error {
+	if cfg.Storage != config.STORAGE_POSTGRES {
+		return fmt.Errorf("%s requires %s storage", args[0], config.STORAGE_POSTGRES)
+	}
+
+	switch args[0] {
+	case COMMAND_REPAIR_BALANCES:
+		return repairBalances(cfg, logger)
+	case COMMAND_MIGRATE:
+		return runMigrate(cfg, logger, args[1:])
+	}
+
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+func repairBalances(cfg config.ServerConfig, logger zerolog.Logger) error {
+	store, err := storage.NewDBController(cfg.DatabaseURI, migrations(), cfg.AutoMigrate, cfg.QueryTimeout, logger)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	created, err := store.RepairBalances(context.Background())
+	if err != nil {
+		return err
+	}
+
+	logger.Info().Int64("created", created).Msg("missing balance rows created")
+	return nil
+}
+
+// runMigrate управляет схемой БД: migrate up | down [N] | version | force V
+func runMigrate(cfg config.ServerConfig, logger zerolog.Logger, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: migrate up | down [N] | version | force V")
+	}
+
+	m, err := storage.NewMigrate(cfg.DatabaseURI, migrations())
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	switch args[0] {
+	case "up":
+		err = m.Up()
+	case "down":
+		// по умолчанию откатываем одну миграцию, откат всей схемы надо запросить явно
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps <= 0 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+		err = m.Steps(-steps)
+	case "version":
+	case "force":
+		if len(args) < 2 {
+			return errors.New("usage: migrate force V")
+		}
+		version, convErr := strconv.Atoi(args[1])
+		if convErr != nil {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		err = m.Force(version)
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+
+	if err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return err
+	}
+
+	version, dirty, err := m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		logger.Info().Msg("database schema is not migrated")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	logger.Info().Uint("version", version).Bool("dirty", dirty).Msg("database schema version")
+	return nil
+}
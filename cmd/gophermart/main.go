@@ -1,18 +1,28 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
+	"internal/accrual"
 	"internal/config"
 	"internal/handlers"
+	"internal/metrics"
+	"internal/storage"
 
 	"github.com/go-chi/chi"
 	_ "github.com/jackc/pgx"
 	_ "github.com/jackc/pgx/stdlib"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
 )
 
@@ -25,21 +35,120 @@ func main() {
 	if err != nil {
 		log.Fatalln(err)
 	}
-	logger := zerolog.New(os.Stdout).Level(1)
+	logger, err := newLogger(cfg)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if flag.NArg() > 0 {
+		if err := runCommand(cfg, logger, flag.Args()); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	var store storage.StorageController
+	switch cfg.Storage {
+	case config.STORAGE_MEMORY:
+		store = storage.NewMemController(logger)
+	default:
+		store, err = storage.NewDBController(cfg.DatabaseURI, migrations(), cfg.AutoMigrate, cfg.QueryTimeout, logger)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	prometheus.MustRegister(metrics.NewStatsCollector(store, cfg.QueryTimeout))
+	store = metrics.InstrumentStorage(store)
 
-	controller := handlers.NewController(cfg, logger)
+	controller := handlers.NewController(cfg, store, logger)
+
+	var accrualClient *accrual.Client
+	if cfg.AccrualAddress != "" {
+		// лимит запросов к системе расчёта общий для всех реплик и хранится в БД
+		accrualClient = accrual.NewClient(cfg.AccrualAddress, cfg.AccrualTimeout).WithLimiter(accrual.NewSharedLimiter(store))
+	}
+
+	var accrualPinger handlers.Pinger
+	if cfg.ReadyAccrual && accrualClient != nil {
+		accrualPinger = accrualClient
+	}
+	health := handlers.NewHealthController(store, accrualPinger)
 
 	r := chi.NewRouter()
+	r.Handle("/metrics", metrics.Handler())
+	r.Get("/healthz", health.HealthzHandler)
+	r.Get("/readyz", health.ReadyzHandler)
+	if cfg.CallbackSecret != "" {
+		r.Mount("/internal/accrual", handlers.NewCallbackController(cfg.CallbackSecret, store, logger).Router())
+	}
 	r.Mount("/", controller.Router())
 
 	server := &http.Server{Addr: cfg.HTTPAddress, Handler: r}
+	serverErr := make(chan error, 1)
 	go func() {
-		if err := server.ListenAndServe(); err != nil {
-			log.Fatalln(err)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serverErr <- err
 		}
 	}()
 
-	<-stop
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+
+	// горутина, которая получает статусы заказов от аккруала с заданной периодичностью
+	if accrualClient != nil {
+		worker := accrual.NewWorker(accrualClient, store, cfg.AccrualDeadAfter, logger)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			worker.Run(ctx)
+		}()
+	} else {
+		logger.Warn().Msg("accrual system address is not set, order statuses will not be updated")
+	}
+
+	select {
+	case <-stop:
+	case err := <-serverErr:
+		logger.Error().Err(err).Msg("http server failed")
+	}
+
+	// сначала /readyz отвечает 503, пока балансировщик не уберёт реплику, затем перестаём принимать
+	// запросы и дожидаемся текущих, останавливаем воркеры и только после этого закрываем хранилище,
+	// которым пользуются и те и другие
+	health.ShutDown()
+	logger.Info().Dur("delay", cfg.DrainDelay).Msg("draining before shutdown")
+	time.Sleep(cfg.DrainDelay)
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer shutdownCancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Error().Err(err).Msg("http server shutdown failed")
+	}
+
+	cancel()
+	wg.Wait()
+
+	if err := store.Close(); err != nil {
+		logger.Error().Err(err).Msg("storage close failed")
+	}
+
+	logger.Info().Msg("server stopped")
+	os.Stdout.Sync()
+}
+
+func newLogger(cfg config.ServerConfig) (zerolog.Logger, error) {
+	level, err := zerolog.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		return zerolog.Logger{}, err
+	}
+
+	var out io.Writer = os.Stdout
+	if cfg.LogFormat == config.LOG_FORMAT_CONSOLE {
+		out = zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}
+	}
 
-	// горутина, которая получает заказы от аккруала с заданной периодичностью (по появлению заказа)
+	return zerolog.New(out).Level(level).With().Timestamp().Logger(), nil
 }
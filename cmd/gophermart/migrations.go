@@ -0,0 +1,19 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed migrations/*.sql
+var embeddedMigrations embed.FS
+
+// migrations - SQL-миграции, вшитые в бинарник, чтобы сервер запускался из любого каталога
+func migrations() fs.FS {
+	sub, err := fs.Sub(embeddedMigrations, "migrations")
+	if err != nil {
+		panic(err)
+	}
+
+	return sub
+}
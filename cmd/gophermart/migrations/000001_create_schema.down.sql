@@ -1,4 +1,7 @@
-drop cascade table balance;
-drop cascade table orders;
-drop cascade table users;
-drop cascade table withdrawals;
\ No newline at end of file
+DROP TABLE IF EXISTS withdrawals CASCADE;
+
+DROP TABLE IF EXISTS balance CASCADE;
+
+DROP TABLE IF EXISTS orders CASCADE;
+
+DROP TABLE IF EXISTS users CASCADE;
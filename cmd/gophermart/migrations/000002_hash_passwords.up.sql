@@ -0,0 +1,3 @@
+-- bcrypt-хеш не помещается в varchar(50); пароли, сохранённые открытым текстом,
+-- перехешируются при следующем входе пользователя
+ALTER TABLE users ALTER COLUMN password TYPE varchar(255);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS withdrawals_order_id_key;
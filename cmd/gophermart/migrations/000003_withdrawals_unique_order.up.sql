@@ -0,0 +1,2 @@
+-- по одному заказу возможно только одно списание
+CREATE UNIQUE INDEX IF NOT EXISTS withdrawals_order_id_key ON withdrawals (order_id);
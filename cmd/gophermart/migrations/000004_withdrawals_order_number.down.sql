@@ -0,0 +1,16 @@
+DROP INDEX IF EXISTS withdrawals_order_number_key;
+
+ALTER TABLE withdrawals ADD COLUMN order_id bigint;
+
+UPDATE withdrawals SET order_id = orders.id FROM orders WHERE withdrawals.order_number = orders.number;
+
+-- списания по заказам, которых нет в orders, в старой схеме не представимы
+DELETE FROM withdrawals WHERE order_id IS NULL;
+
+ALTER TABLE withdrawals ALTER COLUMN order_id SET NOT NULL;
+
+ALTER TABLE withdrawals DROP COLUMN order_number;
+
+ALTER TABLE "withdrawals" ADD FOREIGN KEY ("order_id") REFERENCES "orders" ("id");
+
+CREATE UNIQUE INDEX IF NOT EXISTS withdrawals_order_id_key ON withdrawals (order_id);
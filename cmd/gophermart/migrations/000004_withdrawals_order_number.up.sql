@@ -0,0 +1,12 @@
+-- списание оплачивает новый заказ, которого может не быть в orders, поэтому храним сам номер
+ALTER TABLE withdrawals ADD COLUMN order_number varchar(100);
+
+UPDATE withdrawals SET order_number = orders.number FROM orders WHERE withdrawals.order_id = orders.id;
+
+ALTER TABLE withdrawals ALTER COLUMN order_number SET NOT NULL;
+
+DROP INDEX IF EXISTS withdrawals_order_id_key;
+
+ALTER TABLE withdrawals DROP COLUMN order_id;
+
+CREATE UNIQUE INDEX IF NOT EXISTS withdrawals_order_number_key ON withdrawals (order_number);
@@ -0,0 +1,32 @@
+-- журнал проводок по счёту баллов: начисления положительные, списания отрицательные.
+-- balance остаётся снимком остатка и обновляется в одной транзакции с журналом
+CREATE TABLE IF NOT EXISTS ledger (
+    id serial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    order_number varchar(100) NOT NULL,
+    kind varchar(20) NOT NULL,
+    amount numeric NOT NULL,
+    created_at timestamptz NOT NULL,
+    UNIQUE (order_number, kind)
+    );
+
+ALTER TABLE "ledger" ADD FOREIGN KEY ("user_id") REFERENCES "users" ("id");
+
+CREATE INDEX IF NOT EXISTS ledger_user_id_idx ON ledger (user_id, id);
+
+INSERT INTO ledger (user_id, order_number, kind, amount, created_at)
+SELECT user_id, number, 'ACCRUAL', accrual, uploaded_at FROM orders
+WHERE status = 'PROCESSED' AND accrual IS NOT NULL;
+
+INSERT INTO ledger (user_id, order_number, kind, amount, created_at)
+SELECT user_id, order_number, 'WITHDRAWAL', -sum, processed_at FROM withdrawals;
+
+-- пересобираем снимки остатков из журнала
+DELETE FROM balance;
+
+INSERT INTO balance (user_id, current, withdrawn)
+SELECT users.id,
+    COALESCE(SUM(ledger.amount), 0),
+    COALESCE(-SUM(ledger.amount) FILTER (WHERE ledger.kind = 'WITHDRAWAL'), 0)
+FROM users LEFT JOIN ledger ON ledger.user_id = users.id
+GROUP BY users.id;
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS orders_unprocessed_idx;
+
+ALTER TABLE balance DROP CONSTRAINT IF EXISTS balance_user_id_key;
+
+ALTER TABLE orders DROP CONSTRAINT IF EXISTS orders_number_key;
+
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_login_key;
@@ -0,0 +1,11 @@
+-- уникальность, на которую полагаются AddUser, AddOrder и addLedgerEntry.
+-- Если в таблицах уже есть дубликаты, миграция упадёт и их нужно разобрать вручную
+ALTER TABLE users ADD CONSTRAINT users_login_key UNIQUE (login);
+
+ALTER TABLE orders ADD CONSTRAINT orders_number_key UNIQUE (number);
+
+ALTER TABLE balance ADD CONSTRAINT balance_user_id_key UNIQUE (user_id);
+
+-- внешние ключи orders.user_id, withdrawals.user_id и ledger.user_id покрыты составными
+-- индексами из 000005 и 000006, balance.user_id - уникальным ключом выше
+CREATE INDEX IF NOT EXISTS orders_unprocessed_idx ON orders (status) WHERE status IN ('NEW', 'PROCESSING');
@@ -0,0 +1,19 @@
+-- очередь проверок заказов в системе расчёта баллов. Задача создаётся вместе с заказом,
+-- воркеры забирают её через FOR UPDATE SKIP LOCKED и откладывают next_attempt_at на время обработки,
+-- поэтому задачи не теряются при перезапуске и не обрабатываются двумя репликами одновременно
+CREATE TABLE IF NOT EXISTS accrual_jobs (
+    id serial PRIMARY KEY,
+    order_number varchar(100) NOT NULL UNIQUE REFERENCES orders (number),
+    state varchar(20) NOT NULL,
+    attempts integer NOT NULL DEFAULT 0,
+    next_attempt_at timestamptz NOT NULL,
+    last_error text,
+    created_at timestamptz NOT NULL,
+    updated_at timestamptz NOT NULL
+    );
+
+CREATE INDEX IF NOT EXISTS accrual_jobs_pending_idx ON accrual_jobs (next_attempt_at) WHERE state = 'PENDING';
+
+INSERT INTO accrual_jobs (order_number, state, next_attempt_at, created_at, updated_at)
+SELECT number, 'PENDING', now(), uploaded_at, now() FROM orders
+WHERE status IN ('NEW', 'PROCESSING');
@@ -0,0 +1,11 @@
+-- общий для всех реплик бюджет запросов к системе расчёта баллов: каждый запрос занимает
+-- слот next_slot, после ответа 429 все реплики ждут paused_until
+CREATE TABLE IF NOT EXISTS accrual_rate_limit (
+    id integer PRIMARY KEY CHECK (id = 1),
+    next_slot timestamptz NOT NULL,
+    paused_until timestamptz NOT NULL,
+    interval_ms bigint NOT NULL
+    );
+
+INSERT INTO accrual_rate_limit (id, next_slot, paused_until, interval_ms) VALUES (1, now(), now(), 0)
+ON CONFLICT (id) DO NOTHING;
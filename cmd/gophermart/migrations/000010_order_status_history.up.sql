@@ -0,0 +1,20 @@
+ALTER TABLE orders ADD CONSTRAINT orders_status_check CHECK (status IN ('NEW', 'PROCESSING', 'INVALID', 'PROCESSED'));
+
+-- история статусов заказа, from_status пустой у записи о загрузке
+CREATE TABLE IF NOT EXISTS order_status_history (
+    id serial PRIMARY KEY,
+    order_number varchar(100) NOT NULL REFERENCES orders (number),
+    from_status varchar(50),
+    to_status varchar(50) NOT NULL,
+    source varchar(20) NOT NULL,
+    created_at timestamptz NOT NULL
+    );
+
+CREATE INDEX IF NOT EXISTS order_status_history_order_idx ON order_status_history (order_number, id);
+
+-- для существующих заказов известно только время загрузки и текущий статус
+INSERT INTO order_status_history (order_number, to_status, source, created_at)
+SELECT number, 'NEW', 'UPLOAD', uploaded_at FROM orders;
+
+INSERT INTO order_status_history (order_number, from_status, to_status, source, created_at)
+SELECT number, 'NEW', status, 'BACKFILL', now() FROM orders WHERE status <> 'NEW';
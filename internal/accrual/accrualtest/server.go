@@ -0,0 +1,117 @@
+// Package accrualtest - фейковая система расчёта баллов лояльности для тестов
+package accrualtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"internal/accrual"
+	"internal/storage"
+)
+
+// Step - один ответ по заказу. Если задан Code, сервер отвечает этим кодом
+// вместо статуса расчёта, например 429 или 500
+type Step struct {
+	Status  string
+	Accrual string // десятичная запись, только для PROCESSED
+	Code    int
+}
+
+var (
+	Registered = Step{Status: accrual.REGISTERED}
+	Processing = Step{Status: accrual.PROCESSING}
+	Invalid    = Step{Status: accrual.INVALID}
+	TooMany    = Step{Code: http.StatusTooManyRequests}
+	Failure    = Step{Code: http.StatusInternalServerError}
+)
+
+func Processed(points string) Step {
+	return Step{Status: accrual.PROCESSED, Accrual: points}
+}
+
+type script struct {
+	steps    []Step
+	requests int
+}
+
+// Server отвечает на GET /api/orders/{number} по заранее заданным сценариям.
+// Каждый запрос по заказу переходит к следующему шагу, последний шаг повторяется.
+// На заказы без сценария сервер отвечает 204
+type Server struct {
+	*httptest.Server
+	mu      sync.Mutex
+	scripts map[string]*script
+}
+
+func NewServer() *Server {
+	s := &Server{scripts: make(map[string]*script)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Script задаёт сценарий ответов по заказу, заменяя предыдущий
+func (s *Server) Script(number string, steps ...Step) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.scripts[number] = &script{steps: steps}
+}
+
+// Requests возвращает число запросов по заказу
+func (s *Server) Requests(number string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sc, ok := s.scripts[number]; ok {
+		return sc.requests
+	}
+	return 0
+}
+
+func (s *Server) handle(rw http.ResponseWriter, r *http.Request) {
+	number := strings.TrimPrefix(r.URL.Path, "/api/orders/")
+	if r.Method != http.MethodGet || number == r.URL.Path {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	s.mu.Lock()
+	sc, ok := s.scripts[number]
+	var step Step
+	if ok && len(sc.steps) > 0 {
+		i := sc.requests
+		if i >= len(sc.steps) {
+			i = len(sc.steps) - 1
+		}
+		step = sc.steps[i]
+		sc.requests++
+	}
+	s.mu.Unlock()
+
+	switch {
+	case !ok || len(sc.steps) == 0:
+		rw.WriteHeader(http.StatusNoContent)
+	case step.Code == http.StatusTooManyRequests:
+		rw.Header().Set("Retry-After", "1")
+		rw.WriteHeader(http.StatusTooManyRequests)
+		rw.Write([]byte("No more than 60 requests per minute allowed"))
+	case step.Code != 0:
+		rw.WriteHeader(step.Code)
+	default:
+		info := accrual.OrderInfo{Order: number, Status: step.Status}
+		if step.Accrual != "" {
+			money, err := storage.ParseMoney(step.Accrual)
+			if err != nil {
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			info.Accrual = &money
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(info)
+	}
+}
@@ -0,0 +1,165 @@
+package accrual
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"internal/storage"
+)
+
+var ErrOrderNotRegistered = errors.New("Order is not registered in accrual system!")
+var ErrAccrualUnavailable = errors.New("Accrual system internal error!")
+var ErrUnexpectedStatus = errors.New("Unexpected accrual system response status!")
+
+// ErrLimiter - лимитер не смог выдать разрешение на запрос, например из-за ошибки хранилища.
+// Запрос при этом не отправлялся
+var ErrLimiter = errors.New("Accrual rate limiter failed!")
+
+// defaultRetryAfter используется, если система расчёта не прислала корректный Retry-After
+const defaultRetryAfter = 60 * time.Second
+
+// DEFAULT_TIMEOUT - время на запрос к системе расчёта, если не задано в конфигурации
+const DEFAULT_TIMEOUT = 5 * time.Second
+
+var requestsPerMinuteRe = regexp.MustCompile(`(\d+) requests per minute`)
+
+// TooManyRequestsError возвращается, когда система расчёта ответила 429
+type TooManyRequestsError struct {
+	RetryAfter        time.Duration
+	RequestsPerMinute int
+	PauseErr          error // не удалось приостановить запросы в лимитере, Retry-After соблюдает только этот запрос
+}
+
+func (e *TooManyRequestsError) Error() string {
+	return fmt.Sprintf("accrual system rate limit exceeded, retry after %s", e.RetryAfter)
+}
+
+// статусы расчёта начислений в системе расчёта баллов лояльности
+const (
+	REGISTERED = "REGISTERED"
+	INVALID    = "INVALID"
+	PROCESSING = "PROCESSING"
+	PROCESSED  = "PROCESSED"
+)
+
+type OrderInfo struct {
+	Order   string         `json:"order"`
+	Status  string         `json:"status"`
+	Accrual *storage.Money `json:"accrual,omitempty"`
+}
+
+type Client struct {
+	address string
+	client  *http.Client
+	limiter Limiter
+}
+
+// NewClient создаёт клиент системы расчёта баллов. timeout ограничивает весь запрос,
+// включая установку соединения и чтение тела ответа
+func NewClient(address string, timeout time.Duration) *Client {
+	if timeout <= 0 {
+		timeout = DEFAULT_TIMEOUT
+	}
+
+	if !strings.HasPrefix(address, "http://") && !strings.HasPrefix(address, "https://") {
+		address = "http://" + address
+	}
+
+	return &Client{
+		address: strings.TrimRight(address, "/"),
+		client:  &http.Client{Timeout: timeout},
+		limiter: NewRateLimiter(),
+	}
+}
+
+// WithLimiter заменяет лимитер клиента, например на общий для всех реплик SharedLimiter
+func (c *Client) WithLimiter(limiter Limiter) *Client {
+	c.limiter = limiter
+	return c
+}
+
+// GetOrder делает GET /api/orders/{number} к системе расчёта баллов лояльности.
+// Ответы 204, 429 и 500 возвращаются как ErrOrderNotRegistered, *TooManyRequestsError и ErrAccrualUnavailable
+func (c *Client) GetOrder(ctx context.Context, number string) (OrderInfo, error) {
+	if err := c.limiter.Wait(ctx); err != nil {
+		if ctx.Err() != nil {
+			return OrderInfo{}, ctx.Err()
+		}
+		return OrderInfo{}, fmt.Errorf("%w: %v", ErrLimiter, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.address+"/api/orders/"+number, nil)
+	if err != nil {
+		return OrderInfo{}, err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return OrderInfo{}, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var info OrderInfo
+		if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+			return OrderInfo{}, err
+		}
+		return info, nil
+	case http.StatusNoContent:
+		return OrderInfo{}, ErrOrderNotRegistered
+	case http.StatusTooManyRequests:
+		tooMany := parseTooManyRequests(resp)
+		tooMany.PauseErr = c.limiter.Pause(ctx, tooMany.RetryAfter, tooMany.RequestsPerMinute)
+		return OrderInfo{}, tooMany
+	case http.StatusInternalServerError:
+		return OrderInfo{}, ErrAccrualUnavailable
+	default:
+		return OrderInfo{}, fmt.Errorf("%w: %d", ErrUnexpectedStatus, resp.StatusCode)
+	}
+}
+
+// Ping проверяет, что система расчёта баллов отвечает по HTTP. Код ответа не важен
+func (c *Client) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.address+"/", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// parseTooManyRequests читает Retry-After и лимит запросов в минуту из тела ответа вида
+// "No more than N requests per minute allowed"
+func parseTooManyRequests(resp *http.Response) *TooManyRequestsError {
+	tooMany := &TooManyRequestsError{RetryAfter: defaultRetryAfter}
+
+	retryAfter := resp.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+		tooMany.RetryAfter = time.Duration(seconds) * time.Second
+	} else if at, err := http.ParseTime(retryAfter); err == nil {
+		tooMany.RetryAfter = time.Until(at)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err == nil {
+		if m := requestsPerMinuteRe.FindSubmatch(body); m != nil {
+			tooMany.RequestsPerMinute, _ = strconv.Atoi(string(m[1]))
+		}
+	}
+
+	return tooMany
+}
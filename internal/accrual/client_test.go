@@ -0,0 +1,174 @@
+package accrual_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"internal/accrual"
+	"internal/accrual/accrualtest"
+	"internal/storage"
+
+	"github.com/rs/zerolog"
+)
+
+func TestGetOrder(t *testing.T) {
+	srv := accrualtest.NewServer()
+	defer srv.Close()
+
+	srv.Script("1", accrualtest.Registered, accrualtest.Processed("500.5"))
+	srv.Script("2", accrualtest.Failure)
+	srv.Script("3", accrualtest.Step{Code: http.StatusBadGateway})
+
+	client := accrual.NewClient(srv.URL, time.Second)
+	ctx := context.Background()
+
+	info, err := client.GetOrder(ctx, "1")
+	if err != nil || info.Status != accrual.REGISTERED || info.Accrual != nil {
+		t.Errorf("first step: got %+v, %v", info, err)
+	}
+
+	info, err = client.GetOrder(ctx, "1")
+	if err != nil || info.Status != accrual.PROCESSED || info.Accrual == nil || info.Accrual.String() != "500.5" {
+		t.Errorf("second step: got %+v, %v", info, err)
+	}
+
+	// последний шаг повторяется
+	if info, _ = client.GetOrder(ctx, "1"); info.Status != accrual.PROCESSED {
+		t.Errorf("after script end: got status %s, want %s", info.Status, accrual.PROCESSED)
+	}
+
+	if _, err = client.GetOrder(ctx, "unknown"); !errors.Is(err, accrual.ErrOrderNotRegistered) {
+		t.Errorf("unknown order: got %v, want %v", err, accrual.ErrOrderNotRegistered)
+	}
+
+	if _, err = client.GetOrder(ctx, "2"); !errors.Is(err, accrual.ErrAccrualUnavailable) {
+		t.Errorf("500: got %v, want %v", err, accrual.ErrAccrualUnavailable)
+	}
+
+	if _, err = client.GetOrder(ctx, "3"); !errors.Is(err, accrual.ErrUnexpectedStatus) {
+		t.Errorf("502: got %v, want %v", err, accrual.ErrUnexpectedStatus)
+	}
+}
+
+func TestGetOrderTooManyRequests(t *testing.T) {
+	srv := accrualtest.NewServer()
+	defer srv.Close()
+
+	srv.Script("1", accrualtest.TooMany, accrualtest.Processing)
+
+	client := accrual.NewClient(srv.URL, time.Second)
+
+	_, err := client.GetOrder(context.Background(), "1")
+	var tooMany *accrual.TooManyRequestsError
+	if !errors.As(err, &tooMany) {
+		t.Fatalf("got %v, want TooManyRequestsError", err)
+	}
+	if tooMany.RetryAfter != time.Second || tooMany.RequestsPerMinute != 60 {
+		t.Errorf("got %+v, want retry after 1s and 60 rpm", tooMany)
+	}
+
+	// до истечения Retry-After клиент не отправляет запросы
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err = client.GetOrder(ctx, "1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("during pause: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if n := srv.Requests("1"); n != 1 {
+		t.Errorf("got %d requests during pause, want 1", n)
+	}
+}
+
+func TestSharedLimiter(t *testing.T) {
+	srv := accrualtest.NewServer()
+	defer srv.Close()
+
+	srv.Script("1", accrualtest.TooMany, accrualtest.Processing)
+
+	// два клиента с общим хранилищем - как две реплики с общей БД
+	store := storage.NewMemController(zerolog.Nop())
+	first := accrual.NewClient(srv.URL, time.Second).WithLimiter(accrual.NewSharedLimiter(store))
+	second := accrual.NewClient(srv.URL, time.Second).WithLimiter(accrual.NewSharedLimiter(store))
+
+	var tooMany *accrual.TooManyRequestsError
+	if _, err := first.GetOrder(context.Background(), "1"); !errors.As(err, &tooMany) {
+		t.Fatalf("got %v, want TooManyRequestsError", err)
+	}
+
+	// пауза после 429 у одной реплики останавливает запросы другой
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := second.GetOrder(ctx, "1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("during shared pause: got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	info, err := second.GetOrder(context.Background(), "1")
+	if err != nil || info.Status != accrual.PROCESSING {
+		t.Errorf("after pause: got %+v, %v", info, err)
+	}
+	if n := srv.Requests("1"); n != 2 {
+		t.Errorf("got %d requests, want 2", n)
+	}
+}
+
+// brokenLimiter имитирует общий лимитер, у которого недоступно хранилище
+type brokenLimiter struct {
+	waitErr  error
+	pauseErr error
+}
+
+func (l brokenLimiter) Wait(ctx context.Context) error {
+	return l.waitErr
+}
+
+func (l brokenLimiter) Pause(ctx context.Context, d time.Duration, requestsPerMinute int) error {
+	return l.pauseErr
+}
+
+func TestLimiterErrors(t *testing.T) {
+	srv := accrualtest.NewServer()
+	defer srv.Close()
+
+	srv.Script("1", accrualtest.TooMany)
+	storageErr := errors.New("storage is down")
+
+	// запрос не отправляется, а ошибка отличима от ответов системы расчёта
+	client := accrual.NewClient(srv.URL, time.Second).WithLimiter(brokenLimiter{waitErr: storageErr})
+	if _, err := client.GetOrder(context.Background(), "1"); !errors.Is(err, accrual.ErrLimiter) {
+		t.Errorf("wait failed: got %v, want %v", err, accrual.ErrLimiter)
+	}
+	if n := srv.Requests("1"); n != 0 {
+		t.Errorf("got %d requests, want 0", n)
+	}
+
+	// ошибка паузы не скрывает 429 и Retry-After
+	client = accrual.NewClient(srv.URL, time.Second).WithLimiter(brokenLimiter{pauseErr: storageErr})
+	_, err := client.GetOrder(context.Background(), "1")
+	var tooMany *accrual.TooManyRequestsError
+	if !errors.As(err, &tooMany) {
+		t.Fatalf("pause failed: got %v, want TooManyRequestsError", err)
+	}
+	if tooMany.RetryAfter != time.Second || !errors.Is(tooMany.PauseErr, storageErr) {
+		t.Errorf("pause failed: got %+v, want retry after 1s and pause error", tooMany)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	client := accrual.NewClient(slow.URL, 50*time.Millisecond)
+
+	start := time.Now()
+	if _, err := client.GetOrder(context.Background(), "1"); err == nil {
+		t.Error("got no error from slow server")
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("request took %s, want it cut by 50ms timeout", elapsed)
+	}
+}
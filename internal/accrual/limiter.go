@@ -0,0 +1,113 @@
+package accrual
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"internal/storage"
+)
+
+// Limiter ограничивает частоту запросов к системе расчёта баллов
+type Limiter interface {
+	Wait(ctx context.Context) error // блокирует, пока не разрешит сделать запрос
+	Pause(ctx context.Context, d time.Duration, requestsPerMinute int) error
+}
+
+// RateLimiter ограничивает запросы к системе расчёта баллов. Один лимитер разделяется
+// всеми горутинами, которые ходят в систему расчёта через один Client
+type RateLimiter struct {
+	mu          sync.Mutex
+	pausedUntil time.Time
+	next        time.Time     // момент, раньше которого нельзя делать следующий запрос
+	interval    time.Duration // минимальный интервал между запросами, 0 - без ограничений
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{}
+}
+
+// Wait блокирует вызывающую горутину, пока лимитер не разрешит сделать запрос
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		at := l.pausedUntil
+		if l.next.After(at) {
+			at = l.next
+		}
+
+		if !at.After(now) {
+			l.next = now.Add(l.interval)
+			l.mu.Unlock()
+			return nil
+		}
+		l.mu.Unlock()
+
+		// после ожидания проверяем снова: пауза могла быть продлена другой горутиной
+		timer := time.NewTimer(at.Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Pause приостанавливает все запросы на время d. Если requestsPerMinute > 0,
+// после паузы запросы будут идти не чаще заданного количества в минуту
+func (l *RateLimiter) Pause(ctx context.Context, d time.Duration, requestsPerMinute int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if until := time.Now().Add(d); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+
+	if requestsPerMinute > 0 {
+		l.interval = time.Minute / time.Duration(requestsPerMinute)
+	}
+
+	return nil
+}
+
+// SharedLimiter делит лимит запросов между всеми репликами через хранилище:
+// ответ 429, полученный одной репликой, приостанавливает запросы всех остальных
+type SharedLimiter struct {
+	storage storage.StorageController
+}
+
+func NewSharedLimiter(storage storage.StorageController) *SharedLimiter {
+	return &SharedLimiter{storage: storage}
+}
+
+func (l *SharedLimiter) Wait(ctx context.Context) error {
+	for {
+		wait, err := l.storage.TakeAccrualSlot(ctx)
+		if err != nil {
+			return err
+		}
+		if wait <= 0 {
+			return nil
+		}
+
+		// слот мог занять другой воркер или реплика, поэтому после ожидания пробуем снова
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (l *SharedLimiter) Pause(ctx context.Context, d time.Duration, requestsPerMinute int) error {
+	var interval time.Duration
+	if requestsPerMinute > 0 {
+		interval = time.Minute / time.Duration(requestsPerMinute)
+	}
+
+	return l.storage.PauseAccrual(ctx, d, interval)
+}
@@ -0,0 +1,277 @@
+package accrual
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"internal/metrics"
+	"internal/storage"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	DEFAULT_POLL_INTERVAL = time.Second
+	DEFAULT_RETRY_BASE    = time.Second
+
+	workersCount = 4
+	batchSize    = 100
+
+	// jobLease - на сколько задача скрывается от других воркеров, пока её обрабатывают.
+	// Если воркер упадёт, задача вернётся в очередь по истечении этого времени.
+	// Обработка пачки обрывается за leaseMargin до конца аренды, чтобы заказ
+	// не проверяли одновременно две реплики
+	jobLease    = time.Minute
+	leaseMargin = 10 * time.Second
+
+	retryMax = 5 * time.Minute
+)
+
+// Worker забирает из очереди задачи проверки заказов, опрашивает систему расчёта баллов
+// и переводит заказы в окончательный статус
+type Worker struct {
+	client       *Client
+	storage      storage.StorageController
+	deadAfter    time.Duration // сколько заказ может оставаться незарегистрированным в системе расчёта
+	pollInterval time.Duration
+	retryBase    time.Duration // первая задержка повторной проверки, дальше удваивается
+	logger       zerolog.Logger
+}
+
+func NewWorker(client *Client, storage storage.StorageController, deadAfter time.Duration, logger zerolog.Logger) *Worker {
+	return &Worker{
+		client:       client,
+		storage:      storage,
+		deadAfter:    deadAfter,
+		pollInterval: DEFAULT_POLL_INTERVAL,
+		retryBase:    DEFAULT_RETRY_BASE,
+		logger:       logger,
+	}
+}
+
+// WithTiming задаёт период опроса очереди и начальную задержку повторных проверок,
+// например чтобы тесты проходили сценарий из нескольких статусов за доли секунды
+func (w *Worker) WithTiming(pollInterval time.Duration, retryBase time.Duration) *Worker {
+	w.pollInterval = pollInterval
+	w.retryBase = retryBase
+	return w
+}
+
+func (w *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.poll(ctx)
+		}
+	}
+}
+
+func (w *Worker) poll(ctx context.Context) {
+	claimedAt := time.Now()
+	jobs, err := w.storage.ClaimAccrualJobs(ctx, batchSize, jobLease)
+	if err != nil {
+		w.logger.Error().Err(err).Msg("failed to claim accrual jobs")
+		return
+	}
+
+	ctx, cancel := context.WithDeadline(ctx, claimedAt.Add(jobLease-leaseMargin))
+	defer cancel()
+
+	metrics.AccrualClaimedBatchSize.Set(float64(len(jobs)))
+	defer metrics.AccrualClaimedBatchSize.Set(0)
+
+	queue := make(chan storage.AccrualJob)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var unsent []string
+
+	for i := 0; i < workersCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				if !w.processJob(ctx, job) {
+					mu.Lock()
+					unsent = append(unsent, job.OrderNumber)
+					mu.Unlock()
+				}
+				metrics.AccrualClaimedBatchSize.Dec()
+			}
+		}()
+	}
+
+	// общий лимит запросов обычно меньше пачки, поэтому часть задач не успевает
+	// дойти до системы расчёта к остановке или концу аренды
+	sent := 0
+loop:
+	for _, job := range jobs {
+		select {
+		case <-ctx.Done():
+			break loop
+		case queue <- job:
+			sent++
+		}
+	}
+	close(queue)
+
+	wg.Wait()
+
+	for _, job := range jobs[sent:] {
+		unsent = append(unsent, job.OrderNumber)
+	}
+
+	// такие задачи сразу возвращаем в очередь без штрафа. Контекст опроса к этому моменту
+	// уже может быть отменён, а задачи нужно вернуть и при остановке сервиса
+	if err := w.storage.ReleaseAccrualJobs(context.Background(), unsent); err != nil {
+		w.logger.Error().Err(err).Int("jobs", len(unsent)).Msg("failed to release accrual jobs")
+	}
+}
+
+// processJob возвращает false, если запрос к системе расчёта так и не был отправлен
+func (w *Worker) processJob(ctx context.Context, job storage.AccrualJob) bool {
+	info, err := w.client.GetOrder(ctx, job.OrderNumber)
+	if ctx.Err() != nil {
+		// остановка или конец аренды, пока ждали лимита
+		return false
+	}
+	if errors.Is(err, ErrLimiter) {
+		// запрос не отправлен: это не исход запроса к системе расчёта и не попытка по заказу
+		w.logger.Error().Err(err).Str("order", job.OrderNumber).Msg("failed to take accrual request slot")
+		return false
+	}
+	metrics.AccrualRequests.WithLabelValues(accrualResult(err)).Inc()
+
+	// отказ из-за лимита запросов не говорит ничего о заказе и не увеличивает задержку
+	var tooMany *TooManyRequestsError
+	if errors.As(err, &tooMany) {
+		if tooMany.PauseErr != nil {
+			w.logger.Error().Err(tooMany.PauseErr).Msg("failed to pause accrual requests")
+		}
+		w.logger.Warn().Err(err).Int("rpm", tooMany.RequestsPerMinute).Msg("accrual system is throttling requests")
+		w.retry(ctx, job, tooMany.RetryAfter, err)
+		return true
+	}
+
+	job.Attempts++
+
+	if errors.Is(err, ErrOrderNotRegistered) {
+		w.waitRegistered(ctx, job)
+		return true
+	}
+
+	if err != nil {
+		w.logger.Error().Err(err).Str("order", job.OrderNumber).Msg("failed to get order from accrual system")
+		w.retry(ctx, job, w.backoff(job.Attempts), err)
+		return true
+	}
+
+	status, ok := OrderStatus(info.Status)
+	if !ok {
+		w.logger.Error().Str("order", job.OrderNumber).Str("status", info.Status).Msg("unknown accrual status")
+		w.retry(ctx, job, w.backoff(job.Attempts), nil)
+		return true
+	}
+
+	if status != job.OrderStatus {
+		err = w.storage.UpdateOrderStatus(ctx, job.OrderNumber, status, info.Accrual, storage.SOURCE_POLLING)
+		if errors.Is(err, storage.ErrInvalidTransition) {
+			// заказ уже получил окончательный статус из уведомления, задача закрыта вместе с ним
+			return true
+		}
+		if errors.Is(err, storage.ErrOrderNotFound) {
+			// задача ссылается на заказ, поэтому удалённый заказ уносит и её
+			return true
+		}
+		if err != nil {
+			w.logger.Error().Err(err).Str("order", job.OrderNumber).Msg("failed to update order status")
+			return true
+		}
+	}
+
+	// окончательный статус закрывает задачу в UpdateOrderStatus, остальные проверяем повторно
+	switch {
+	case info.Status == REGISTERED:
+		w.waitRegistered(ctx, job)
+	case status == storage.STATUS_PROCESSING:
+		w.retry(ctx, job, w.backoff(job.Attempts), nil)
+	}
+
+	return true
+}
+
+// waitRegistered откладывает проверку заказа, который система расчёта ещё не начала обрабатывать,
+// а слишком долго ждущие заказы переводит в DEAD
+func (w *Worker) waitRegistered(ctx context.Context, job storage.AccrualJob) {
+	if time.Since(job.CreatedAt) < w.deadAfter {
+		w.retry(ctx, job, w.backoff(job.Attempts), nil)
+		return
+	}
+
+	w.logger.Warn().Str("order", job.OrderNumber).Int("attempts", job.Attempts).Msg("order is stuck in accrual system, job is dead")
+
+	err := w.storage.DeadAccrualJob(ctx, job.OrderNumber, "order is not processed by accrual system for "+w.deadAfter.String())
+	if err != nil {
+		w.logger.Error().Err(err).Str("order", job.OrderNumber).Msg("failed to park accrual job")
+	}
+}
+
+func (w *Worker) retry(ctx context.Context, job storage.AccrualJob, delay time.Duration, cause error) {
+	var lastErr string
+	if cause != nil {
+		lastErr = cause.Error()
+	}
+
+	err := w.storage.RetryAccrualJob(ctx, job.OrderNumber, job.Attempts, delay, lastErr)
+	if err != nil {
+		w.logger.Error().Err(err).Str("order", job.OrderNumber).Msg("failed to reschedule accrual job")
+	}
+}
+
+// backoff - экспоненциальная задержка перед следующей попыткой: retryBase, 2*retryBase... но не больше retryMax
+func (w *Worker) backoff(attempts int) time.Duration {
+	delay := w.retryBase
+	for i := 1; i < attempts && delay < retryMax; i++ {
+		delay *= 2
+	}
+
+	if delay > retryMax {
+		return retryMax
+	}
+	return delay
+}
+
+// OrderStatus переводит статус системы расчёта баллов в статус заказа
+func OrderStatus(accrualStatus string) (storage.OrderStatus, bool) {
+	switch accrualStatus {
+	case REGISTERED, PROCESSING:
+		return storage.STATUS_PROCESSING, true
+	case INVALID:
+		return storage.STATUS_INVALID, true
+	case PROCESSED:
+		return storage.STATUS_PROCESSED, true
+	}
+
+	return "", false
+}
+
+// accrualResult возвращает метку исхода запроса к системе расчёта баллов для метрик
+func accrualResult(err error) string {
+	var tooMany *TooManyRequestsError
+	switch {
+	case err == nil:
+		return metrics.ACCRUAL_OK
+	case errors.Is(err, ErrOrderNotRegistered):
+		return metrics.ACCRUAL_NOT_REGISTERED
+	case errors.As(err, &tooMany):
+		return metrics.ACCRUAL_TOO_MANY_REQUESTS
+	}
+
+	return metrics.ACCRUAL_ERROR
+}
@@ -0,0 +1,159 @@
+package accrual_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"internal/accrual"
+	"internal/accrual/accrualtest"
+	"internal/storage"
+
+	"github.com/rs/zerolog"
+)
+
+func TestWorker(t *testing.T) {
+	srv := accrualtest.NewServer()
+	defer srv.Close()
+
+	store := storage.NewMemController(zerolog.Nop())
+	for _, number := range []string{"processed", "invalid", "stuck", "unknown"} {
+		if _, err := store.AddOrder(context.Background(), 1, number); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv.Script("processed", accrualtest.Processed("500"))
+	srv.Script("invalid", accrualtest.Invalid)
+	srv.Script("stuck", accrualtest.Registered)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// при нулевом deadAfter незарегистрированные заказы сразу уходят в DEAD
+	go accrual.NewWorker(accrual.NewClient(srv.URL, time.Second), store, 0, zerolog.Nop()).Run(ctx)
+
+	for {
+		stats, err := store.GetStats(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if stats.JobsByState[storage.JOB_DONE] == 2 && stats.JobsByState[storage.JOB_DEAD] == 2 {
+			if stats.Accrued != 50000 {
+				t.Errorf("got accrued %s, want 500", stats.Accrued)
+			}
+			if stats.OrdersByStatus[storage.STATUS_PROCESSED] != 1 || stats.OrdersByStatus[storage.STATUS_INVALID] != 1 {
+				t.Errorf("unexpected order statuses: %v", stats.OrdersByStatus)
+			}
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Fatalf("jobs were not processed: %v", stats.JobsByState)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	// закрытые задачи больше не опрашиваются
+	requests := srv.Requests("processed")
+	time.Sleep(1500 * time.Millisecond)
+	if n := srv.Requests("processed"); n != requests {
+		t.Errorf("finished job was polled again: %d requests, want %d", n, requests)
+	}
+}
+
+func TestWorkerSharedBudget(t *testing.T) {
+	srv := accrualtest.NewServer()
+	defer srv.Close()
+
+	store := storage.NewMemController(zerolog.Nop())
+
+	const jobs = 20
+	for i := 0; i < jobs; i++ {
+		number := strconv.Itoa(1000 + i)
+		if _, err := store.AddOrder(context.Background(), 1, number); err != nil {
+			t.Fatal(err)
+		}
+		srv.Script(number, accrualtest.Processed("1"))
+	}
+
+	// общий лимит - один запрос в 300ms, за секунду успевает уйти не больше пяти запросов из пачки
+	if err := store.PauseAccrual(context.Background(), 0, 300*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	client := accrual.NewClient(srv.URL, time.Second).WithLimiter(accrual.NewSharedLimiter(store))
+	accrual.NewWorker(client, store, time.Hour, zerolog.Nop()).WithTiming(10*time.Millisecond, 10*time.Millisecond).Run(ctx)
+
+	stats, err := store.GetStats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := stats.JobsByState[storage.JOB_DONE]
+	if done == 0 || done > 5 {
+		t.Fatalf("got %d processed jobs, want between 1 and 5", done)
+	}
+
+	// задачи, по которым запрос не ушёл, сразу доступны для следующего опроса и не получили штрафа
+	claimed, err := store.ClaimAccrualJobs(context.Background(), jobs, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(claimed) != jobs-done {
+		t.Errorf("got %d claimable jobs after stop, want %d", len(claimed), jobs-done)
+	}
+	for _, job := range claimed {
+		if job.Attempts != 0 {
+			t.Errorf("job %s: got %d attempts, want 0", job.OrderNumber, job.Attempts)
+		}
+		if n := srv.Requests(job.OrderNumber); n != 0 {
+			t.Errorf("job %s: got %d requests, want 0", job.OrderNumber, n)
+		}
+	}
+}
+
+// failingLimiter не выдаёт слотов, как общий лимитер при недоступной БД
+type failingLimiter struct{}
+
+func (failingLimiter) Wait(ctx context.Context) error {
+	return errors.New("storage is down")
+}
+
+func (failingLimiter) Pause(ctx context.Context, d time.Duration, requestsPerMinute int) error {
+	return nil
+}
+
+func TestWorkerLimiterFailure(t *testing.T) {
+	srv := accrualtest.NewServer()
+	defer srv.Close()
+
+	store := storage.NewMemController(zerolog.Nop())
+	if _, err := store.AddOrder(context.Background(), 1, "1000"); err != nil {
+		t.Fatal(err)
+	}
+	srv.Script("1000", accrualtest.Processed("1"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	client := accrual.NewClient(srv.URL, time.Second).WithLimiter(failingLimiter{})
+	accrual.NewWorker(client, store, time.Hour, zerolog.Nop()).WithTiming(10*time.Millisecond, time.Minute).Run(ctx)
+
+	// запрос не ушёл, поэтому задача не получила попытку и задержку и сразу доступна снова
+	claimed, err := store.ClaimAccrualJobs(context.Background(), 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claimed) != 1 || claimed[0].Attempts != 0 {
+		t.Errorf("got claimable jobs %+v, want one job without attempts", claimed)
+	}
+}
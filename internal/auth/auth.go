@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const COOKIE_NAME string = "gophermartCookie"
+
+var ErrInvalidToken = errors.New("Token is not valid!")
+
+type claims struct {
+	UserID int `json:"user_id"`
+	jwt.StandardClaims
+}
+
+type contextKey struct{}
+
+// NewToken выпускает подписанный токен для пользователя, действительный в течение ttl
+func NewToken(userID int, secret []byte, ttl time.Duration) (string, error) {
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims{
+		UserID: userID,
+		StandardClaims: jwt.StandardClaims{
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(ttl).Unix(),
+		},
+	})
+
+	return token.SignedString(secret)
+}
+
+// ParseToken проверяет подпись и срок действия токена и возвращает id пользователя
+func ParseToken(tokenString string, secret []byte) (int, error) {
+	var c claims
+	token, err := jwt.ParseWithClaims(tokenString, &c, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return secret, nil
+	})
+
+	if err != nil || !token.Valid || c.UserID == 0 {
+		return 0, ErrInvalidToken
+	}
+
+	return c.UserID, nil
+}
+
+func WithUserID(ctx context.Context, userID int) context.Context {
+	return context.WithValue(ctx, contextKey{}, userID)
+}
+
+// UserID возвращает id аутентифицированного пользователя из контекста запроса
+func UserID(ctx context.Context) (int, bool) {
+	userID, ok := ctx.Value(contextKey{}).(int)
+	return userID, ok
+}
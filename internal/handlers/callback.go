@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"internal/accrual"
+	"internal/middleware"
+	"internal/storage"
+
+	"github.com/go-chi/chi"
+	chimiddleware "github.com/go-chi/chi/middleware"
+	"github.com/rs/zerolog"
+)
+
+// SIGNATURE_HEADER содержит HMAC-SHA256 строки "<timestamp>.<тело запроса>" в виде "sha256=<hex>",
+// TIMESTAMP_HEADER - время отправки уведомления в секундах Unix
+const (
+	SIGNATURE_HEADER = "X-Signature"
+	TIMESTAMP_HEADER = "X-Timestamp"
+)
+
+const (
+	maxCallbackBody = 1 << 20
+
+	// callbackMaxAge - насколько время отправки может расходиться с нашим. Подписанное
+	// уведомление нельзя повторить позже, а повтор внутри окна ничего не меняет
+	callbackMaxAge = 5 * time.Minute
+)
+
+// CallbackController принимает уведомления об изменении статуса заказа от адаптера
+// на стороне системы расчёта баллов. Работает рядом с опросом и через тот же UpdateOrderStatus
+type CallbackController struct {
+	storage storage.StorageController
+	logger  zerolog.Logger
+	secret  []byte
+}
+
+func NewCallbackController(secret string, storage storage.StorageController, logger zerolog.Logger) *CallbackController {
+	return &CallbackController{
+		storage: storage,
+		logger:  logger,
+		secret:  []byte(secret),
+	}
+}
+
+// Router монтируется на /internal/accrual в обход авторизации пользователей
+func (c *CallbackController) Router() chi.Router {
+	r := chi.NewRouter()
+
+	r.Use(chimiddleware.RequestID, middleware.LogHandle(c.logger), middleware.MetricsHandle)
+
+	r.Post("/callback", c.callbackHandler)
+
+	return r
+}
+
+func (c *CallbackController) callbackHandler(rw http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxCallbackBody))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	timestamp := r.Header.Get(TIMESTAMP_HEADER)
+	if !validTimestamp(timestamp, time.Now()) {
+		http.Error(rw, "wrong timestamp", http.StatusUnauthorized)
+		return
+	}
+
+	if !c.validSignature(timestamp, body, r.Header.Get(SIGNATURE_HEADER)) {
+		http.Error(rw, "wrong signature", http.StatusUnauthorized)
+		return
+	}
+
+	var info accrual.OrderInfo
+	if err := json.Unmarshal(body, &info); err != nil || info.Order == "" {
+		http.Error(rw, "wrong request format", http.StatusBadRequest)
+		return
+	}
+
+	status, ok := accrual.OrderStatus(info.Status)
+	if !ok {
+		http.Error(rw, "unknown status", http.StatusBadRequest)
+		return
+	}
+
+	// баллы начисляются только вместе со статусом PROCESSED, как при опросе системы расчёта
+	if status != storage.STATUS_PROCESSED {
+		info.Accrual = nil
+	}
+
+	// повторные уведомления ничего не меняют, а откат из INVALID или PROCESSED
+	// отклоняется проверкой перехода и только пишется в лог
+	err = c.storage.UpdateOrderStatus(r.Context(), info.Order, status, info.Accrual, storage.SOURCE_CALLBACK)
+	if errors.Is(err, storage.ErrInvalidTransition) {
+		zerolog.Ctx(r.Context()).Info().Str("order", info.Order).Str("status", string(status)).Msg("accrual callback ignored")
+		err = nil
+	}
+	// адаптер должен узнать, что прислал номер, которого у нас нет
+	if errors.Is(err, storage.ErrOrderNotFound) {
+		zerolog.Ctx(r.Context()).Warn().Str("order", info.Order).Msg("accrual callback for unknown order")
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Str("order", info.Order).Msg("failed to apply accrual callback")
+		http.Error(rw, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+}
+
+func validTimestamp(header string, now time.Time) bool {
+	sec, err := strconv.ParseInt(header, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	age := now.Sub(time.Unix(sec, 0))
+	return age < callbackMaxAge && age > -callbackMaxAge
+}
+
+func (c *CallbackController) validSignature(timestamp string, body []byte, header string) bool {
+	signature, err := hex.DecodeString(strings.TrimPrefix(header, "sha256="))
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal(signature, sign(c.secret, timestamp, body))
+}
+
+func sign(secret []byte, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return mac.Sum(nil)
+}
+
+// Sign возвращает значение заголовка X-Signature для уведомления с заголовком X-Timestamp = timestamp
+func Sign(secret string, timestamp string, body []byte) string {
+	return "sha256=" + hex.EncodeToString(sign([]byte(secret), timestamp, body))
+}
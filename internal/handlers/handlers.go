@@ -3,45 +3,45 @@ package handlers
 import (
 	"encoding/json"
 	"errors"
+	"internal/auth"
 	"internal/config"
 	"internal/middleware"
 	"internal/storage"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi"
+	chimiddleware "github.com/go-chi/chi/middleware"
 	"github.com/rs/zerolog"
 )
 
-const COOKIE_NAME string = "gophermartCookie"
-
 type Controller struct {
-	storage storage.StorageController // интерфейс для взаимодействия с БД
-	logger  zerolog.Logger
+	storage  storage.StorageController // интерфейс для взаимодействия с БД
+	logger   zerolog.Logger
+	secret   []byte // ключ подписи токенов
+	tokenTTL time.Duration
 }
 
-func NewController(cfg config.ServerConfig, logger zerolog.Logger) *Controller {
-	storage, err := storage.NewDBController(cfg.DatabaseURI, logger)
-
-	if err != nil {
-		log.Fatalln(err)
-	}
-
+func NewController(cfg config.ServerConfig, storage storage.StorageController, logger zerolog.Logger) *Controller {
 	return &Controller{
-		storage: storage,
-		logger:  logger,
+		storage:  storage,
+		logger:   logger,
+		secret:   []byte(cfg.SecretKey),
+		tokenTTL: cfg.TokenTTL,
 	}
 }
 
 func (c Controller) Router() chi.Router {
 	r := chi.NewRouter()
 
-	r.Use(middleware.GzipHandle, middleware.UnGzipHandle, middleware.CheckCookieHandle)
+	r.Use(chimiddleware.RequestID, middleware.LogHandle(c.logger), middleware.MetricsHandle, middleware.GzipHandle, middleware.UnGzipHandle, middleware.CheckTokenHandle(c.secret))
 
 	r.Get("/api/user/orders", c.userGetOrdersHandler)
+	r.Get("/api/user/orders/{number}", c.userGetOrderTimelineHandler)
 	r.Get("/api/user/balance", c.userBalanceHandler)
 	r.Get("/api/user/withdrawals", c.userWithdrawalsHandler)
+	r.Get("/api/user/balance/ledger", c.userLedgerHandler)
 
 	r.Post("/api/user/register", c.userRegisterHandler)
 	r.Post("/api/user/login", c.userLoginHandler)
@@ -52,16 +52,15 @@ func (c Controller) Router() chi.Router {
 }
 
 func (c Controller) userGetOrdersHandler(rw http.ResponseWriter, r *http.Request) {
-	username := r.Header.Get("Authorization")
+	userId, _ := auth.UserID(r.Context())
 
-	exist, _ := c.storage.IsUserExist(username)
-
-	if !exist {
-		http.Error(rw, "User does not exist!", http.StatusUnauthorized)
+	filter, err := parseListFilter(r, true)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	orders, err := c.storage.GetOrders(username)
+	orders, err := c.storage.GetOrders(r.Context(), userId, filter)
 
 	if err != nil {
 		http.Error(rw, "server error", http.StatusInternalServerError)
@@ -74,6 +73,7 @@ func (c Controller) userGetOrdersHandler(rw http.ResponseWriter, r *http.Request
 	}
 
 	body, err := json.Marshal(orders.Orders)
+	setNextCursor(rw, orders.Next)
 	rw.Header().Set("Content-Type", "application/json")
 	if err == nil {
 		rw.Write([]byte(body))
@@ -82,17 +82,34 @@ func (c Controller) userGetOrdersHandler(rw http.ResponseWriter, r *http.Request
 	}
 }
 
-func (c Controller) userBalanceHandler(rw http.ResponseWriter, r *http.Request) {
-	username := r.Header.Get("Authorization")
+func (c Controller) userGetOrderTimelineHandler(rw http.ResponseWriter, r *http.Request) {
+	userId, _ := auth.UserID(r.Context())
 
-	exist, _ := c.storage.IsUserExist(username)
+	timeline, err := c.storage.GetOrderTimeline(r.Context(), userId, chi.URLParam(r, "number"))
 
-	if !exist {
-		http.Error(rw, "User does not exist!", http.StatusUnauthorized)
+	if errors.Is(err, storage.ErrOrderNotFound) {
+		http.Error(rw, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	userBalance, err := c.storage.GetBalance(username)
+	if err != nil {
+		http.Error(rw, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(timeline)
+	rw.Header().Set("Content-Type", "application/json")
+	if err == nil {
+		rw.Write([]byte(body))
+	} else {
+		http.Error(rw, "server error", http.StatusInternalServerError)
+	}
+}
+
+func (c Controller) userBalanceHandler(rw http.ResponseWriter, r *http.Request) {
+	userId, _ := auth.UserID(r.Context())
+
+	userBalance, err := c.storage.GetBalance(r.Context(), userId)
 
 	if err != nil {
 		http.Error(rw, "server error", http.StatusInternalServerError)
@@ -109,16 +126,15 @@ func (c Controller) userBalanceHandler(rw http.ResponseWriter, r *http.Request)
 }
 
 func (c Controller) userWithdrawalsHandler(rw http.ResponseWriter, r *http.Request) {
-	username := r.Header.Get("Authorization")
+	userId, _ := auth.UserID(r.Context())
 
-	exist, _ := c.storage.IsUserExist(username)
-
-	if !exist {
-		http.Error(rw, "User does not exist!", http.StatusUnauthorized)
+	filter, err := parseListFilter(r, false)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	withdrawals, err := c.storage.GetWithdrawals(username)
+	withdrawals, err := c.storage.GetWithdrawals(r.Context(), userId, filter)
 
 	if err != nil {
 		http.Error(rw, "server error", http.StatusInternalServerError)
@@ -130,7 +146,32 @@ func (c Controller) userWithdrawalsHandler(rw http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	body, err := json.Marshal(withdrawals)
+	body, err := json.Marshal(withdrawals.WithDrawals)
+	setNextCursor(rw, withdrawals.Next)
+	rw.Header().Set("Content-Type", "application/json")
+	if err == nil {
+		rw.Write([]byte(body))
+	} else {
+		http.Error(rw, "server error", http.StatusInternalServerError)
+	}
+}
+
+func (c Controller) userLedgerHandler(rw http.ResponseWriter, r *http.Request) {
+	userId, _ := auth.UserID(r.Context())
+
+	entries, err := c.storage.GetLedger(r.Context(), userId)
+
+	if err != nil {
+		http.Error(rw, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	if len(entries) == 0 {
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	body, err := json.Marshal(entries)
 	rw.Header().Set("Content-Type", "application/json")
 	if err == nil {
 		rw.Write([]byte(body))
@@ -145,15 +186,23 @@ func (c Controller) userRegisterHandler(rw http.ResponseWriter, r *http.Request)
 		http.Error(rw, err.Error(), http.StatusBadRequest)
 		return
 	}
-	err := c.storage.AddUser(userInfo)
+	userId, err := c.storage.AddUser(r.Context(), userInfo)
 
 	if err != nil {
-		http.Error(rw, err.Error(), http.StatusConflict)
+		switch {
+		case errors.Is(err, storage.ErrEmptyCredentials), errors.Is(err, storage.ErrCredentialsTooLong):
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, storage.ErrUserExists):
+			http.Error(rw, err.Error(), http.StatusConflict)
+		default:
+			zerolog.Ctx(r.Context()).Error().Err(err).Msg("register failed")
+			http.Error(rw, "server error", http.StatusInternalServerError)
+		}
 		return
 	}
-	cookie := createCookieForUser(userInfo.Login)
-	http.SetCookie(rw, &cookie)
-	rw.Header().Add("Authorization", userInfo.Login)
+
+	// по спецификации успешная регистрация сразу аутентифицирует пользователя
+	c.authorize(rw, userId)
 }
 
 func (c Controller) userLoginHandler(rw http.ResponseWriter, r *http.Request) {
@@ -163,17 +212,26 @@ func (c Controller) userLoginHandler(rw http.ResponseWriter, r *http.Request) {
 		http.Error(rw, err.Error(), http.StatusBadRequest)
 		return
 	}
-	err := c.storage.IsUserValid(userInfo)
+	if err := userInfo.Validate(); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	userId, err := c.storage.IsUserValid(r.Context(), userInfo)
 
 	if err != nil {
-		c.logger.Err(err).Msg("")
+		if !errors.Is(err, storage.ErrWrongCredentials) {
+			zerolog.Ctx(r.Context()).Error().Err(err).Msg("login failed")
+			http.Error(rw, "server error", http.StatusInternalServerError)
+			return
+		}
+
+		zerolog.Ctx(r.Context()).Info().Err(err).Str("login", userInfo.Login).Msg("login failed")
 		http.Error(rw, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	cookie := createCookieForUser(userInfo.Login)
-	http.SetCookie(rw, &cookie)
-	rw.Header().Add("Authorization", userInfo.Login)
+	c.authorize(rw, userId)
 }
 
 func (c Controller) userPostOrdersHandler(rw http.ResponseWriter, r *http.Request) {
@@ -183,10 +241,9 @@ func (c Controller) userPostOrdersHandler(rw http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	username := r.Header.Get("Authorization")
+	userId, _ := auth.UserID(r.Context())
 
 	requestData, err := ioutil.ReadAll(r.Body)
-	c.logger.Info().Msg(string(requestData))
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
@@ -199,7 +256,7 @@ func (c Controller) userPostOrdersHandler(rw http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	orderCode, err := c.storage.AddOrder(username, string(requestData))
+	orderCode, err := c.storage.AddOrder(r.Context(), userId, string(requestData))
 
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
@@ -227,14 +284,7 @@ func (c Controller) userPostWithDrawBalanceHandler(rw http.ResponseWriter, r *ht
 		return
 	}
 
-	username := r.Header.Get("Authorization")
-
-	exist, _ := c.storage.IsUserExist(username)
-
-	if !exist {
-		http.Error(rw, "User does not exist!", http.StatusUnauthorized)
-		return
-	}
+	userId, _ := auth.UserID(r.Context())
 
 	var withdrawal storage.WithDrawal
 	if err := json.NewDecoder(r.Body).Decode(&withdrawal); err != nil {
@@ -249,12 +299,21 @@ func (c Controller) userPostWithDrawBalanceHandler(rw http.ResponseWriter, r *ht
 		return
 	}
 
-	err = c.storage.WithdrawBalance(username, withdrawal)
+	if withdrawal.Sum <= 0 {
+		http.Error(rw, storage.ErrInvalidWithdrawalSum.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	err = c.storage.WithdrawBalance(r.Context(), userId, withdrawal)
 
 	if err != nil {
 		switch {
 		case errors.Is(err, storage.ErrNotEnoughBalance):
 			http.Error(rw, storage.ErrNotEnoughBalance.Error(), http.StatusPaymentRequired)
+		case errors.Is(err, storage.ErrOrderAlreadyWithdrawn):
+			http.Error(rw, storage.ErrOrderAlreadyWithdrawn.Error(), http.StatusConflict)
+		case errors.Is(err, storage.ErrInvalidWithdrawalSum):
+			http.Error(rw, storage.ErrInvalidWithdrawalSum.Error(), http.StatusUnprocessableEntity)
 		default:
 			http.Error(rw, "server error", http.StatusInternalServerError)
 		}
@@ -264,12 +323,26 @@ func (c Controller) userPostWithDrawBalanceHandler(rw http.ResponseWriter, r *ht
 	rw.WriteHeader(http.StatusOK)
 }
 
-func createCookieForUser(login string) http.Cookie {
+// authorize выпускает токен для пользователя и отдаёт его в заголовке Authorization и в cookie
+func (c Controller) authorize(rw http.ResponseWriter, userId int) {
+	token, err := auth.NewToken(userId, c.secret, c.tokenTTL)
+
+	if err != nil {
+		http.Error(rw, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	cookie := createCookieForUser(token, c.tokenTTL)
+	http.SetCookie(rw, &cookie)
+	rw.Header().Add("Authorization", "Bearer "+token)
+}
+
+func createCookieForUser(token string, ttl time.Duration) http.Cookie {
 	return http.Cookie{
-		Name:     COOKIE_NAME,
-		Value:    login,
+		Name:     auth.COOKIE_NAME,
+		Value:    token,
 		Path:     "/",
-		MaxAge:   3600,
+		MaxAge:   int(ttl.Seconds()),
 		HttpOnly: true,
 		Secure:   true,
 		SameSite: http.SameSiteLaxMode,
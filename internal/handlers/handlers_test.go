@@ -0,0 +1,784 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"internal/accrual"
+	"internal/accrual/accrualtest"
+	"internal/auth"
+	"internal/config"
+	"internal/storage"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/rs/zerolog"
+)
+
+type testServer struct {
+	*httptest.Server
+	storage *storage.MemController
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	cfg := config.ServerConfig{
+		SecretKey: "test-secret",
+		TokenTTL:  time.Hour,
+	}
+	store := storage.NewMemController(zerolog.Nop())
+
+	srv := httptest.NewServer(NewController(cfg, store, zerolog.Nop()).Router())
+	t.Cleanup(srv.Close)
+
+	return &testServer{Server: srv, storage: store}
+}
+
+type request struct {
+	method      string
+	path        string
+	token       string
+	contentType string
+	body        string
+}
+
+func (s *testServer) do(t *testing.T, r request) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(r.method, s.URL+r.path, strings.NewReader(r.body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.token != "" {
+		req.Header.Set("Authorization", r.token)
+	}
+	if r.contentType != "" {
+		req.Header.Set("Content-Type", r.contentType)
+	}
+
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	return resp
+}
+
+// register регистрирует пользователя и возвращает значение заголовка Authorization
+func (s *testServer) register(t *testing.T, login string) string {
+	t.Helper()
+
+	resp := s.do(t, request{
+		method:      http.MethodPost,
+		path:        "/api/user/register",
+		contentType: "application/json",
+		body:        `{"login":"` + login + `","password":"secret"}`,
+	})
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("register %s: got status %d", login, resp.StatusCode)
+	}
+
+	token := resp.Header.Get("Authorization")
+	if token == "" {
+		t.Fatalf("register %s: Authorization header is empty", login)
+	}
+
+	return token
+}
+
+func (s *testServer) uploadOrder(t *testing.T, token string, number string) {
+	t.Helper()
+
+	resp := s.do(t, request{method: http.MethodPost, path: "/api/user/orders", token: token, contentType: "text/plain", body: number})
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("upload order %s: got status %d", number, resp.StatusCode)
+	}
+}
+
+// accrue загружает заказ и ждёт, пока фейковая система расчёта начислит за него баллы
+func (s *testServer) accrue(t *testing.T, token string, number string, points string) {
+	t.Helper()
+
+	s.uploadOrder(t, token, number)
+
+	accrualSrv := accrualtest.NewServer()
+	defer accrualSrv.Close()
+	accrualSrv.Script(number, accrualtest.Registered, accrualtest.Processing, accrualtest.Processed(points))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// короткие интервалы, чтобы заказ прошёл REGISTERED -> PROCESSING -> PROCESSED через очередь за доли секунды
+	worker := accrual.NewWorker(accrual.NewClient(accrualSrv.URL, time.Second), s.storage, time.Hour, zerolog.Nop()).
+		WithTiming(10*time.Millisecond, 10*time.Millisecond)
+	go worker.Run(ctx)
+
+	for {
+		resp := s.do(t, request{method: http.MethodGet, path: "/api/user/orders", token: token})
+
+		var orders []storage.Order
+		if err := json.NewDecoder(resp.Body).Decode(&orders); err != nil {
+			t.Fatal(err)
+		}
+		for _, o := range orders {
+			if o.Number == number && o.Status == storage.STATUS_PROCESSED {
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Fatalf("order %s was not processed", number)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	srv := newTestServer(t)
+	srv.register(t, "existing")
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{name: "new user", body: `{"login":"new","password":"secret"}`, wantStatus: http.StatusOK},
+		{name: "login taken", body: `{"login":"existing","password":"other"}`, wantStatus: http.StatusConflict},
+		{name: "malformed json", body: `{"login":`, wantStatus: http.StatusBadRequest},
+		{name: "empty login", body: `{"login":"","password":"secret"}`, wantStatus: http.StatusBadRequest},
+		{name: "empty password", body: `{"login":"nopassword"}`, wantStatus: http.StatusBadRequest},
+		{name: "longest login", body: `{"login":"` + strings.Repeat("л", storage.MAX_LOGIN_LENGTH) + `","password":"secret"}`, wantStatus: http.StatusOK},
+		{name: "login too long", body: `{"login":"` + strings.Repeat("l", storage.MAX_LOGIN_LENGTH+1) + `","password":"secret"}`, wantStatus: http.StatusBadRequest},
+		{name: "password too long", body: `{"login":"longpassword","password":"` + strings.Repeat("p", storage.MAX_PASSWORD_LENGTH+1) + `"}`, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := srv.do(t, request{method: http.MethodPost, path: "/api/user/register", contentType: "application/json", body: tt.body})
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			token := resp.Header.Get("Authorization")
+			if token == "" {
+				t.Fatal("Authorization header is empty after registration")
+			}
+			if len(resp.Cookies()) == 0 {
+				t.Error("auth cookie is not set after registration")
+			}
+
+			// зарегистрированный пользователь сразу авторизован
+			resp = srv.do(t, request{method: http.MethodGet, path: "/api/user/balance", token: token})
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("balance right after registration: got status %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestLogin(t *testing.T) {
+	srv := newTestServer(t)
+	srv.register(t, "user")
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{name: "valid credentials", body: `{"login":"user","password":"secret"}`, wantStatus: http.StatusOK},
+		{name: "wrong password", body: `{"login":"user","password":"wrong"}`, wantStatus: http.StatusUnauthorized},
+		{name: "unknown user", body: `{"login":"nobody","password":"secret"}`, wantStatus: http.StatusUnauthorized},
+		{name: "malformed json", body: `not json`, wantStatus: http.StatusBadRequest},
+		{name: "empty password", body: `{"login":"user","password":""}`, wantStatus: http.StatusBadRequest},
+		{name: "login too long", body: `{"login":"` + strings.Repeat("l", storage.MAX_LOGIN_LENGTH+1) + `","password":"secret"}`, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := srv.do(t, request{method: http.MethodPost, path: "/api/user/login", contentType: "application/json", body: tt.body})
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+
+			if tt.wantStatus == http.StatusOK && resp.Header.Get("Authorization") == "" {
+				t.Error("Authorization header is empty after login")
+			}
+		})
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	srv := newTestServer(t)
+	srv.register(t, "alice")
+
+	// токены зарегистрированного пользователя, которые ParseToken должен отклонить
+	const userId = 1
+	otherSecret, err := auth.NewToken(userId, []byte("other-secret"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := auth.NewToken(userId, []byte("test-secret"), -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{
+		"user_id": userId,
+		"exp":     time.Now().Add(time.Hour).Unix(),
+	}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// тот же пользователь с правильно подписанным токеном проходит авторизацию
+	valid, err := auth.NewToken(userId, []byte("test-secret"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := srv.do(t, request{method: http.MethodGet, path: "/api/user/balance", token: "Bearer " + valid}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("valid token: got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	routes := []request{
+		{method: http.MethodGet, path: "/api/user/orders"},
+		{method: http.MethodPost, path: "/api/user/orders", contentType: "text/plain", body: "12345678903"},
+		{method: http.MethodGet, path: "/api/user/balance"},
+		{method: http.MethodPost, path: "/api/user/balance/withdraw", contentType: "application/json", body: `{"order":"2377225624","sum":1}`},
+		{method: http.MethodGet, path: "/api/user/withdrawals"},
+		{method: http.MethodGet, path: "/api/user/balance/ledger"},
+		{method: http.MethodGet, path: "/api/user/orders/12345678903"},
+	}
+
+	tokens := map[string]string{
+		"no token":      "",
+		"raw login":     "alice",
+		"garbage token": "Bearer not.a.token",
+		"other secret":  "Bearer " + otherSecret,
+		"expired token": "Bearer " + expired,
+		"alg none":      "Bearer " + unsigned,
+	}
+
+	for _, route := range routes {
+		for name, token := range tokens {
+			t.Run(route.method+" "+route.path+" "+name, func(t *testing.T) {
+				route.token = token
+				resp := srv.do(t, route)
+
+				if resp.StatusCode != http.StatusUnauthorized {
+					t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+				}
+			})
+		}
+	}
+}
+
+func TestPostOrders(t *testing.T) {
+	srv := newTestServer(t)
+	owner := srv.register(t, "owner")
+	other := srv.register(t, "other")
+	srv.uploadOrder(t, owner, "79927398713")
+
+	tests := []struct {
+		name        string
+		token       string
+		contentType string
+		body        string
+		wantStatus  int
+	}{
+		{name: "new order", token: owner, contentType: "text/plain", body: "12345678903", wantStatus: http.StatusAccepted},
+		{name: "uploaded by same user", token: owner, contentType: "text/plain", body: "79927398713", wantStatus: http.StatusOK},
+		{name: "uploaded by another user", token: other, contentType: "text/plain", body: "79927398713", wantStatus: http.StatusConflict},
+		{name: "luhn check failed", token: owner, contentType: "text/plain", body: "12345678901", wantStatus: http.StatusUnprocessableEntity},
+		{name: "not a number", token: owner, contentType: "text/plain", body: "abc", wantStatus: http.StatusUnprocessableEntity},
+		{name: "wrong content type", token: owner, contentType: "application/json", body: `"12345678903"`, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := srv.do(t, request{method: http.MethodPost, path: "/api/user/orders", token: tt.token, contentType: tt.contentType, body: tt.body})
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestGetOrders(t *testing.T) {
+	srv := newTestServer(t)
+	token := srv.register(t, "user")
+
+	resp := srv.do(t, request{method: http.MethodGet, path: "/api/user/orders", token: token})
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("empty list: got status %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+
+	// спецификация требует порядок от старых заказов к новым. Порядок загрузки не совпадает
+	// с порядком номеров, чтобы сортировка по номеру не прошла проверку
+	numbers := []string{"79927398713", "12345678903", "2377225624"}
+	for _, number := range numbers {
+		srv.uploadOrder(t, token, number)
+	}
+
+	resp = srv.do(t, request{method: http.MethodGet, path: "/api/user/orders", token: token})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("got Content-Type %q, want application/json", ct)
+	}
+
+	var orders []storage.Order
+	if err := json.NewDecoder(resp.Body).Decode(&orders); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(orders) != len(numbers) {
+		t.Fatalf("got %d orders, want %d: %+v", len(orders), len(numbers), orders)
+	}
+	for i, o := range orders {
+		if o.Number != numbers[i] || o.Status != storage.STATUS_NEW {
+			t.Errorf("order %d: got %s %s, want %s NEW", i, o.Number, o.Status, numbers[i])
+		}
+	}
+}
+
+func TestOrdersPagination(t *testing.T) {
+	srv := newTestServer(t)
+	token := srv.register(t, "user")
+
+	numbers := []string{"12345678903", "79927398713", "2377225624"}
+	for _, number := range numbers {
+		srv.uploadOrder(t, token, number)
+	}
+
+	seen := make(map[string]bool)
+	path := "/api/user/orders?limit=2"
+	for pages := 0; path != ""; pages++ {
+		if pages == len(numbers) {
+			t.Fatal("pagination does not terminate")
+		}
+
+		resp := srv.do(t, request{method: http.MethodGet, path: path, token: token})
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: got status %d, want %d", path, resp.StatusCode, http.StatusOK)
+		}
+
+		var orders []storage.Order
+		if err := json.NewDecoder(resp.Body).Decode(&orders); err != nil {
+			t.Fatal(err)
+		}
+		if len(orders) > 2 {
+			t.Errorf("%s: got %d orders, want at most 2", path, len(orders))
+		}
+		for _, o := range orders {
+			if seen[o.Number] {
+				t.Errorf("order %s returned twice", o.Number)
+			}
+			seen[o.Number] = true
+		}
+
+		path = ""
+		if cursor := resp.Header.Get(NEXT_CURSOR_HEADER); cursor != "" {
+			path = "/api/user/orders?limit=2&cursor=" + cursor
+		}
+	}
+
+	if len(seen) != len(numbers) {
+		t.Errorf("got %d orders over all pages, want %d", len(seen), len(numbers))
+	}
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/api/user/orders?status=NEW", http.StatusOK},
+		{"/api/user/orders?status=PROCESSED", http.StatusNoContent},
+		{"/api/user/orders?from=2000-01-01T00:00:00Z&to=2001-01-01T00:00:00Z", http.StatusNoContent},
+		{"/api/user/orders?status=UNKNOWN", http.StatusBadRequest},
+		{"/api/user/orders?limit=0", http.StatusBadRequest},
+		{"/api/user/orders?cursor=broken", http.StatusBadRequest},
+		{"/api/user/orders?from=yesterday", http.StatusBadRequest},
+		{"/api/user/withdrawals?status=NEW", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		resp := srv.do(t, request{method: http.MethodGet, path: tt.path, token: token})
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.path, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestBalanceAndWithdraw(t *testing.T) {
+	srv := newTestServer(t)
+	token := srv.register(t, "user")
+
+	resp := srv.do(t, request{method: http.MethodGet, path: "/api/user/withdrawals", token: token})
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("empty withdrawals: got status %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+
+	srv.accrue(t, token, "12345678903", "500.5")
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{name: "not enough points", body: `{"order":"2377225624","sum":1000}`, wantStatus: http.StatusPaymentRequired},
+		{name: "invalid order number", body: `{"order":"2377225625","sum":1}`, wantStatus: http.StatusUnprocessableEntity},
+		{name: "malformed json", body: `{"order":`, wantStatus: http.StatusBadRequest},
+		{name: "negative sum", body: `{"order":"79927398713","sum":-100}`, wantStatus: http.StatusUnprocessableEntity},
+		{name: "zero sum", body: `{"order":"79927398713","sum":0}`, wantStatus: http.StatusUnprocessableEntity},
+		{name: "enough points", body: `{"order":"2377225624","sum":100.25}`, wantStatus: http.StatusOK},
+		{name: "repeated withdrawal", body: `{"order":"2377225624","sum":100.25}`, wantStatus: http.StatusOK},
+		{name: "repeated order with other sum", body: `{"order":"2377225624","sum":300}`, wantStatus: http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := srv.do(t, request{method: http.MethodPost, path: "/api/user/balance/withdraw", token: token, contentType: "application/json", body: tt.body})
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+
+	resp = srv.do(t, request{method: http.MethodGet, path: "/api/user/balance", token: token})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("balance: got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := `{"current":400.25,"withdrawn":100.25}`; string(body) != want {
+		t.Errorf("balance: got %s, want %s", body, want)
+	}
+
+	resp = srv.do(t, request{method: http.MethodPost, path: "/api/user/balance/withdraw", token: token, contentType: "application/json", body: `{"order":"49927398716","sum":50}`})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("second withdrawal: got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	resp = srv.do(t, request{method: http.MethodGet, path: "/api/user/withdrawals", token: token})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("withdrawals: got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	// спецификация требует массив списаний от старых к новым
+	var withdrawals []storage.WithDrawal
+	if err := json.NewDecoder(resp.Body).Decode(&withdrawals); err != nil {
+		t.Fatalf("withdrawals: response is not a JSON array: %v", err)
+	}
+
+	want := []storage.WithDrawal{{Order: "2377225624", Sum: 10025}, {Order: "49927398716", Sum: 5000}}
+	if len(withdrawals) != len(want) {
+		t.Fatalf("withdrawals: got %+v, want %+v", withdrawals, want)
+	}
+	for i, w := range withdrawals {
+		if w.Order != want[i].Order || w.Sum != want[i].Sum || w.ProcessedAt.IsZero() {
+			t.Errorf("withdrawal %d: got %+v, want %+v", i, w, want[i])
+		}
+	}
+
+	other := srv.register(t, "other")
+	resp = srv.do(t, request{method: http.MethodPost, path: "/api/user/balance/withdraw", token: other, contentType: "application/json", body: `{"order":"2377225624","sum":1}`})
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("order paid by another user: got status %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+}
+
+func TestGzip(t *testing.T) {
+	srv := newTestServer(t)
+	token := srv.register(t, "user")
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("12345678903"))
+	gz.Close()
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/user/orders", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Content-Encoding", "gzip")
+
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("gzip request: got status %d, want %d", resp.StatusCode, http.StatusAccepted)
+	}
+
+	req, err = http.NewRequest(http.MethodGet, srv.URL+"/api/user/orders", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", token)
+	// явный Accept-Encoding отключает прозрачную распаковку в http.Transport
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err = srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("gzip response: got Content-Encoding %q", resp.Header.Get("Content-Encoding"))
+	}
+
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var orders []storage.Order
+	if err := json.NewDecoder(zr).Decode(&orders); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(orders) != 1 || orders[0].Number != "12345678903" {
+		t.Errorf("unexpected orders: %+v", orders)
+	}
+}
+
+type failingPinger struct{}
+
+func (failingPinger) Ping(ctx context.Context) error {
+	return io.ErrUnexpectedEOF
+}
+
+func TestHealth(t *testing.T) {
+	readyz := func(h *HealthController) (int, ReadyStatus) {
+		rec := httptest.NewRecorder()
+		h.ReadyzHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+		var status ReadyStatus
+		if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, status
+	}
+
+	store := storage.NewMemController(zerolog.Nop())
+
+	rec := httptest.NewRecorder()
+	NewHealthController(store, nil).HealthzHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("healthz: status %d, want 200", rec.Code)
+	}
+
+	h := NewHealthController(store, nil)
+	if code, status := readyz(h); code != http.StatusOK || status.Components["storage"].Status != HEALTH_OK {
+		t.Errorf("readyz: %d %+v, want 200 with storage ok", code, status)
+	}
+
+	// во время задержки перед остановкой /readyz уже отвечает 503, а /healthz - 200
+	h.ShutDown()
+	if code, status := readyz(h); code != http.StatusServiceUnavailable || status.Status != HEALTH_FAIL || status.Components["server"].Status != HEALTH_FAIL {
+		t.Errorf("readyz during shutdown: %d %+v, want 503 with server fail", code, status)
+	}
+
+	rec = httptest.NewRecorder()
+	h.HealthzHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("healthz during shutdown: status %d, want 200", rec.Code)
+	}
+
+	code, status := readyz(NewHealthController(store, failingPinger{}))
+	if code != http.StatusServiceUnavailable || status.Components["accrual"].Status != HEALTH_FAIL {
+		t.Errorf("readyz with unreachable accrual: %d %+v, want 503 with accrual fail", code, status)
+	}
+}
+
+func TestAccrualCallback(t *testing.T) {
+	const secret = "callback-secret"
+
+	srv := newTestServer(t)
+	token := srv.register(t, "user")
+	srv.uploadOrder(t, token, "12345678903")
+
+	callback := httptest.NewServer(NewCallbackController(secret, srv.storage, zerolog.Nop()).Router())
+	defer callback.Close()
+
+	post := func(body string, timestamp string, signature string) int {
+		req, err := http.NewRequest(http.MethodPost, callback.URL+"/callback", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(TIMESTAMP_HEADER, timestamp)
+		req.Header.Set(SIGNATURE_HEADER, signature)
+
+		resp, err := callback.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	balance := func() string {
+		resp := srv.do(t, request{method: http.MethodGet, path: "/api/user/balance", token: token})
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	orderAccrual := func() string {
+		orders, err := srv.storage.GetOrders(context.Background(), 1, storage.ListFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(orders.Orders) != 1 || orders.Orders[0].Accrual == nil {
+			return ""
+		}
+		return orders.Orders[0].Accrual.String()
+	}
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	processed := `{"order":"12345678903","status":"PROCESSED","accrual":100}`
+
+	tests := []struct {
+		name        string
+		body        string
+		timestamp   string
+		signature   string
+		wantStatus  int
+		wantBalance string
+		wantAccrual string
+	}{
+		{name: "wrong signature", body: processed, signature: Sign("other", now, []byte(processed)), wantStatus: http.StatusUnauthorized, wantBalance: `{"current":0,"withdrawn":0}`},
+		{name: "malformed timestamp", body: processed, timestamp: "yesterday", signature: Sign(secret, "yesterday", []byte(processed)), wantStatus: http.StatusUnauthorized, wantBalance: `{"current":0,"withdrawn":0}`},
+		{name: "replayed later", body: processed, timestamp: stale, signature: Sign(secret, stale, []byte(processed)), wantStatus: http.StatusUnauthorized, wantBalance: `{"current":0,"withdrawn":0}`},
+		{name: "timestamp not signed", body: processed, signature: Sign(secret, stale, []byte(processed)), wantStatus: http.StatusUnauthorized, wantBalance: `{"current":0,"withdrawn":0}`},
+		{name: "unknown status", body: `{"order":"12345678903","status":"DONE"}`, wantStatus: http.StatusBadRequest, wantBalance: `{"current":0,"withdrawn":0}`},
+		{name: "unknown order", body: `{"order":"79927398713","status":"PROCESSED","accrual":100}`, wantStatus: http.StatusNotFound, wantBalance: `{"current":0,"withdrawn":0}`},
+		{name: "processing with accrual", body: `{"order":"12345678903","status":"PROCESSING","accrual":100}`, wantStatus: http.StatusOK, wantBalance: `{"current":0,"withdrawn":0}`},
+		{name: "processed", body: processed, wantStatus: http.StatusOK, wantBalance: `{"current":100,"withdrawn":0}`, wantAccrual: "100"},
+		{name: "repeated", body: processed, wantStatus: http.StatusOK, wantBalance: `{"current":100,"withdrawn":0}`, wantAccrual: "100"},
+		{name: "regression", body: `{"order":"12345678903","status":"PROCESSING"}`, wantStatus: http.StatusOK, wantBalance: `{"current":100,"withdrawn":0}`, wantAccrual: "100"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			timestamp := tt.timestamp
+			if timestamp == "" {
+				timestamp = now
+			}
+
+			signature := tt.signature
+			if signature == "" {
+				signature = Sign(secret, timestamp, []byte(tt.body))
+			}
+
+			if status := post(tt.body, timestamp, signature); status != tt.wantStatus {
+				t.Errorf("got status %d, want %d", status, tt.wantStatus)
+			}
+
+			if got := strings.TrimSpace(balance()); got != tt.wantBalance {
+				t.Errorf("got balance %s, want %s", got, tt.wantBalance)
+			}
+
+			if got := orderAccrual(); got != tt.wantAccrual {
+				t.Errorf("got order accrual %q, want %q", got, tt.wantAccrual)
+			}
+		})
+	}
+
+	orders, err := srv.storage.GetOrders(context.Background(), 1, storage.ListFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders.Orders) != 1 || orders.Orders[0].Status != storage.STATUS_PROCESSED {
+		t.Errorf("unexpected orders after callbacks: %+v", orders.Orders)
+	}
+}
+
+func TestOrderTimeline(t *testing.T) {
+	srv := newTestServer(t)
+	token := srv.register(t, "user")
+	other := srv.register(t, "other")
+	srv.uploadOrder(t, token, "12345678903")
+
+	ctx := context.Background()
+	for _, update := range []struct {
+		status storage.OrderStatus
+		source string
+	}{
+		{storage.STATUS_PROCESSING, storage.SOURCE_POLLING},
+		{storage.STATUS_PROCESSED, storage.SOURCE_CALLBACK},
+	} {
+		if err := srv.storage.UpdateOrderStatus(ctx, "12345678903", update.status, nil, update.source); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// из окончательного статуса назад не переходим, история не меняется
+	err := srv.storage.UpdateOrderStatus(ctx, "12345678903", storage.STATUS_PROCESSING, nil, storage.SOURCE_POLLING)
+	if !errors.Is(err, storage.ErrInvalidTransition) {
+		t.Errorf("PROCESSED -> PROCESSING: got %v, want %v", err, storage.ErrInvalidTransition)
+	}
+
+	resp := srv.do(t, request{method: http.MethodGet, path: "/api/user/orders/12345678903", token: token})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	var timeline storage.OrderTimeline
+	if err := json.NewDecoder(resp.Body).Decode(&timeline); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []storage.StatusChange{
+		{To: storage.STATUS_NEW, Source: storage.SOURCE_UPLOAD},
+		{From: storage.STATUS_NEW, To: storage.STATUS_PROCESSING, Source: storage.SOURCE_POLLING},
+		{From: storage.STATUS_PROCESSING, To: storage.STATUS_PROCESSED, Source: storage.SOURCE_CALLBACK},
+	}
+	if timeline.Status != storage.STATUS_PROCESSED || len(timeline.History) != len(want) {
+		t.Fatalf("unexpected timeline: %+v", timeline)
+	}
+	for i, change := range timeline.History {
+		if change.From != want[i].From || change.To != want[i].To || change.Source != want[i].Source || change.At.IsZero() {
+			t.Errorf("history[%d]: got %+v, want %+v", i, change, want[i])
+		}
+	}
+
+	for name, r := range map[string]request{
+		"another user's order": {method: http.MethodGet, path: "/api/user/orders/12345678903", token: other},
+		"unknown order":        {method: http.MethodGet, path: "/api/user/orders/79927398713", token: token},
+	} {
+		if resp := srv.do(t, r); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: got status %d, want %d", name, resp.StatusCode, http.StatusNotFound)
+		}
+	}
+}
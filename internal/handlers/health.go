@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	"internal/storage"
+)
+
+// состояния компонентов в ответе /readyz
+const (
+	HEALTH_OK   = "ok"
+	HEALTH_FAIL = "fail"
+)
+
+// Pinger - компонент, доступность которого проверяется в /readyz
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+type ComponentStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type ReadyStatus struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentStatus `json:"components"`
+}
+
+type HealthController struct {
+	storage      storage.StorageController
+	accrual      Pinger // nil, если проверка системы расчёта отключена
+	shuttingDown int32
+}
+
+func NewHealthController(storage storage.StorageController, accrual Pinger) *HealthController {
+	return &HealthController{
+		storage: storage,
+		accrual: accrual,
+	}
+}
+
+// ShutDown переводит /readyz в 503, чтобы балансировщик перестал присылать новые запросы
+func (h *HealthController) ShutDown() {
+	atomic.StoreInt32(&h.shuttingDown, 1)
+}
+
+// HealthzHandler отвечает 200, пока процесс жив
+func (h *HealthController) HealthzHandler(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(ComponentStatus{Status: HEALTH_OK})
+}
+
+// ReadyzHandler проверяет хранилище и, если включено, систему расчёта баллов
+func (h *HealthController) ReadyzHandler(rw http.ResponseWriter, r *http.Request) {
+	ready := ReadyStatus{Status: HEALTH_OK, Components: make(map[string]ComponentStatus)}
+
+	check := func(name string, p Pinger) {
+		status := ComponentStatus{Status: HEALTH_OK}
+		if err := p.Ping(r.Context()); err != nil {
+			status = ComponentStatus{Status: HEALTH_FAIL, Error: err.Error()}
+			ready.Status = HEALTH_FAIL
+		}
+		ready.Components[name] = status
+	}
+
+	if atomic.LoadInt32(&h.shuttingDown) == 1 {
+		ready.Status = HEALTH_FAIL
+		ready.Components["server"] = ComponentStatus{Status: HEALTH_FAIL, Error: "shutting down"}
+	}
+
+	check("storage", h.storage)
+	if h.accrual != nil {
+		check("accrual", h.accrual)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if ready.Status != HEALTH_OK {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(rw).Encode(ready)
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"internal/storage"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// NEXT_CURSOR_HEADER - заголовок с курсором следующей страницы, отсутствует на последней
+const NEXT_CURSOR_HEADER = "X-Next-Cursor"
+
+var ErrInvalidListQuery = errors.New("Wrong list query parameters!")
+
+// parseListFilter читает limit, cursor, from, to и, если разрешено, status из строки запроса.
+// Без параметров возвращает пустой фильтр - полный список, как требует спецификация
+func parseListFilter(r *http.Request, withStatus bool) (storage.ListFilter, error) {
+	var filter storage.ListFilter
+	q := r.URL.Query()
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxPageSize {
+			return storage.ListFilter{}, ErrInvalidListQuery
+		}
+		filter.Limit = limit
+	}
+
+	if v := q.Get("cursor"); v != "" {
+		cursor, err := storage.ParseCursor(v)
+		if err != nil {
+			return storage.ListFilter{}, ErrInvalidListQuery
+		}
+		filter.Cursor = &cursor
+
+		if filter.Limit == 0 {
+			filter.Limit = defaultPageSize
+		}
+	}
+
+	if v := storage.OrderStatus(q.Get("status")); v != "" {
+		if !withStatus || !v.Valid() {
+			return storage.ListFilter{}, ErrInvalidListQuery
+		}
+		filter.Status = v
+	}
+
+	for name, dst := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if v := q.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return storage.ListFilter{}, ErrInvalidListQuery
+			}
+			*dst = t
+		}
+	}
+
+	return filter, nil
+}
+
+func setNextCursor(rw http.ResponseWriter, next *storage.Cursor) {
+	if next != nil {
+		rw.Header().Set(NEXT_CURSOR_HEADER, next.String())
+	}
+}
@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// результаты запросов к системе расчёта баллов
+const (
+	ACCRUAL_OK                = "ok"
+	ACCRUAL_NOT_REGISTERED    = "not_registered"
+	ACCRUAL_TOO_MANY_REQUESTS = "too_many_requests"
+	ACCRUAL_ERROR             = "error"
+)
+
+// результаты вызовов хранилища
+const (
+	STORAGE_OK       = "ok"
+	STORAGE_REJECTED = "rejected" // отказ по бизнес-правилам: неверный пароль, не хватает баллов и т.п.
+	STORAGE_ERROR    = "error"
+)
+
+var (
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gophermart_http_requests_total",
+		Help: "HTTP requests by route and status code.",
+	}, []string{"method", "route", "status"})
+
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gophermart_http_request_duration_seconds",
+		Help:    "HTTP request latency by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	StorageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gophermart_storage_duration_seconds",
+		Help:    "Storage call duration by StorageController method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "result"})
+
+	AccrualRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gophermart_accrual_requests_total",
+		Help: "Requests to the accrual system by outcome.",
+	}, []string{"result"})
+
+	// глубину всей очереди показывает gophermart_accrual_jobs{state="PENDING"}
+	AccrualClaimedBatchSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gophermart_accrual_claimed_batch_size",
+		Help: "Accrual jobs claimed by this replica in the current poll and not processed yet.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(HTTPRequests, HTTPDuration, StorageDuration, AccrualRequests, AccrualClaimedBatchSize)
+}
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"internal/storage"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// statsTTL - как долго отдаются сохранённые агрегаты. GetStats проходит по всем заказам,
+// задачам и проводкам, поэтому частые опросы /metrics с каждой реплики не должны нагружать БД
+const statsTTL = 30 * time.Second
+
+// StatsCollector читает агрегаты из хранилища при опросе /metrics не чаще раза в statsTTL,
+// поэтому значения не сбрасываются при перезапуске сервиса
+type StatsCollector struct {
+	storage   storage.StorageController
+	timeout   time.Duration
+	mu        sync.Mutex // одновременные опросы ждут один запрос к хранилищу
+	stats     storage.Stats
+	fetchedAt time.Time
+	orders    *prometheus.Desc
+	jobs      *prometheus.Desc
+	accrued   *prometheus.Desc
+	withdrawn *prometheus.Desc
+}
+
+func NewStatsCollector(s storage.StorageController, timeout time.Duration) *StatsCollector {
+	return &StatsCollector{
+		storage:   s,
+		timeout:   timeout,
+		orders:    prometheus.NewDesc("gophermart_orders", "Orders by status.", []string{"status"}, nil),
+		jobs:      prometheus.NewDesc("gophermart_accrual_jobs", "Accrual check jobs by state.", []string{"state"}, nil),
+		accrued:   prometheus.NewDesc("gophermart_points_accrued_total", "Points accrued to all users.", nil, nil),
+		withdrawn: prometheus.NewDesc("gophermart_points_withdrawn_total", "Points withdrawn by all users.", nil, nil),
+	}
+}
+
+func (c *StatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.orders
+	ch <- c.jobs
+	ch <- c.accrued
+	ch <- c.withdrawn
+}
+
+func (c *StatsCollector) Collect(ch chan<- prometheus.Metric) {
+	stats, err := c.getStats()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.orders, err)
+		return
+	}
+
+	for status, count := range stats.OrdersByStatus {
+		ch <- prometheus.MustNewConstMetric(c.orders, prometheus.GaugeValue, float64(count), string(status))
+	}
+
+	for state, count := range stats.JobsByState {
+		ch <- prometheus.MustNewConstMetric(c.jobs, prometheus.GaugeValue, float64(count), state)
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.accrued, prometheus.CounterValue, float64(stats.Accrued)/100)
+	ch <- prometheus.MustNewConstMetric(c.withdrawn, prometheus.CounterValue, float64(stats.Withdrawn)/100)
+}
+
+// getStats возвращает сохранённые агрегаты, пока они не старше statsTTL. Ошибка не сохраняется,
+// следующий опрос снова пойдёт в хранилище
+func (c *StatsCollector) getStats() (storage.Stats, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.fetchedAt.IsZero() && time.Since(c.fetchedAt) < statsTTL {
+		return c.stats, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	stats, err := c.storage.GetStats(ctx)
+	if err != nil {
+		return storage.Stats{}, err
+	}
+
+	c.stats, c.fetchedAt = stats, time.Now()
+	return stats, nil
+}
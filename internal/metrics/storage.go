@@ -0,0 +1,149 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"internal/storage"
+)
+
+// instrumentedStorage замеряет длительность каждого вызова StorageController
+type instrumentedStorage struct {
+	next storage.StorageController
+}
+
+func InstrumentStorage(s storage.StorageController) storage.StorageController {
+	return &instrumentedStorage{next: s}
+}
+
+// rejections - ожидаемые отказы хранилища по бизнес-правилам. Они не говорят о сбое БД
+// и не должны попадать в долю ошибок хранилища
+var rejections = []error{
+	storage.ErrWrongCredentials,
+	storage.ErrEmptyCredentials,
+	storage.ErrCredentialsTooLong,
+	storage.ErrUserExists,
+	storage.ErrNotEnoughBalance,
+	storage.ErrOrderAlreadyWithdrawn,
+	storage.ErrInvalidWithdrawalSum,
+	storage.ErrInvalidTransition,
+	storage.ErrOrderNotFound,
+}
+
+func observe(method string, start time.Time, err error) {
+	StorageDuration.WithLabelValues(method, storageResult(err)).Observe(time.Since(start).Seconds())
+}
+
+func storageResult(err error) string {
+	if err == nil {
+		return STORAGE_OK
+	}
+
+	for _, rejection := range rejections {
+		if errors.Is(err, rejection) {
+			return STORAGE_REJECTED
+		}
+	}
+
+	return STORAGE_ERROR
+}
+
+func (s *instrumentedStorage) IsUserExist(ctx context.Context, login string) (exist bool, err error) {
+	defer func(start time.Time) { observe("IsUserExist", start, err) }(time.Now())
+	return s.next.IsUserExist(ctx, login)
+}
+
+func (s *instrumentedStorage) IsUserValid(ctx context.Context, user storage.UserInfo) (userId int, err error) {
+	defer func(start time.Time) { observe("IsUserValid", start, err) }(time.Now())
+	return s.next.IsUserValid(ctx, user)
+}
+
+func (s *instrumentedStorage) AddUser(ctx context.Context, user storage.UserInfo) (userId int, err error) {
+	defer func(start time.Time) { observe("AddUser", start, err) }(time.Now())
+	return s.next.AddUser(ctx, user)
+}
+
+func (s *instrumentedStorage) AddOrder(ctx context.Context, userId int, number string) (code storage.AddOrderReturn, err error) {
+	defer func(start time.Time) { observe("AddOrder", start, err) }(time.Now())
+	return s.next.AddOrder(ctx, userId, number)
+}
+
+func (s *instrumentedStorage) GetOrders(ctx context.Context, userId int, filter storage.ListFilter) (orders storage.Orders, err error) {
+	defer func(start time.Time) { observe("GetOrders", start, err) }(time.Now())
+	return s.next.GetOrders(ctx, userId, filter)
+}
+
+func (s *instrumentedStorage) GetBalance(ctx context.Context, userId int) (balance storage.UserBalance, err error) {
+	defer func(start time.Time) { observe("GetBalance", start, err) }(time.Now())
+	return s.next.GetBalance(ctx, userId)
+}
+
+func (s *instrumentedStorage) GetWithdrawals(ctx context.Context, userId int, filter storage.ListFilter) (withdrawals storage.WithDrawals, err error) {
+	defer func(start time.Time) { observe("GetWithdrawals", start, err) }(time.Now())
+	return s.next.GetWithdrawals(ctx, userId, filter)
+}
+
+func (s *instrumentedStorage) WithdrawBalance(ctx context.Context, userId int, withdrawal storage.WithDrawal) (err error) {
+	defer func(start time.Time) { observe("WithdrawBalance", start, err) }(time.Now())
+	return s.next.WithdrawBalance(ctx, userId, withdrawal)
+}
+
+func (s *instrumentedStorage) UpdateOrderStatus(ctx context.Context, number string, status storage.OrderStatus, accrual *storage.Money, source string) (err error) {
+	defer func(start time.Time) { observe("UpdateOrderStatus", start, err) }(time.Now())
+	return s.next.UpdateOrderStatus(ctx, number, status, accrual, source)
+}
+
+func (s *instrumentedStorage) GetOrderTimeline(ctx context.Context, userId int, number string) (timeline storage.OrderTimeline, err error) {
+	defer func(start time.Time) { observe("GetOrderTimeline", start, err) }(time.Now())
+	return s.next.GetOrderTimeline(ctx, userId, number)
+}
+
+func (s *instrumentedStorage) ClaimAccrualJobs(ctx context.Context, limit int, lease time.Duration) (jobs []storage.AccrualJob, err error) {
+	defer func(start time.Time) { observe("ClaimAccrualJobs", start, err) }(time.Now())
+	return s.next.ClaimAccrualJobs(ctx, limit, lease)
+}
+
+func (s *instrumentedStorage) RetryAccrualJob(ctx context.Context, number string, attempts int, delay time.Duration, lastErr string) (err error) {
+	defer func(start time.Time) { observe("RetryAccrualJob", start, err) }(time.Now())
+	return s.next.RetryAccrualJob(ctx, number, attempts, delay, lastErr)
+}
+
+func (s *instrumentedStorage) ReleaseAccrualJobs(ctx context.Context, numbers []string) (err error) {
+	defer func(start time.Time) { observe("ReleaseAccrualJobs", start, err) }(time.Now())
+	return s.next.ReleaseAccrualJobs(ctx, numbers)
+}
+
+func (s *instrumentedStorage) DeadAccrualJob(ctx context.Context, number string, reason string) (err error) {
+	defer func(start time.Time) { observe("DeadAccrualJob", start, err) }(time.Now())
+	return s.next.DeadAccrualJob(ctx, number, reason)
+}
+
+func (s *instrumentedStorage) TakeAccrualSlot(ctx context.Context) (wait time.Duration, err error) {
+	defer func(start time.Time) { observe("TakeAccrualSlot", start, err) }(time.Now())
+	return s.next.TakeAccrualSlot(ctx)
+}
+
+func (s *instrumentedStorage) PauseAccrual(ctx context.Context, pause time.Duration, interval time.Duration) (err error) {
+	defer func(start time.Time) { observe("PauseAccrual", start, err) }(time.Now())
+	return s.next.PauseAccrual(ctx, pause, interval)
+}
+
+func (s *instrumentedStorage) GetLedger(ctx context.Context, userId int) (entries []storage.LedgerEntry, err error) {
+	defer func(start time.Time) { observe("GetLedger", start, err) }(time.Now())
+	return s.next.GetLedger(ctx, userId)
+}
+
+func (s *instrumentedStorage) GetStats(ctx context.Context) (stats storage.Stats, err error) {
+	defer func(start time.Time) { observe("GetStats", start, err) }(time.Now())
+	return s.next.GetStats(ctx)
+}
+
+func (s *instrumentedStorage) Ping(ctx context.Context) (err error) {
+	defer func(start time.Time) { observe("Ping", start, err) }(time.Now())
+	return s.next.Ping(ctx)
+}
+
+func (s *instrumentedStorage) Close() error {
+	return s.next.Close()
+}
@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	chimiddleware "github.com/go-chi/chi/middleware"
+	"github.com/rs/zerolog"
+)
+
+// LogHandle пишет по одной структурированной записи на запрос и кладёт в контекст логгер
+// с request_id, чтобы записи хендлеров и хранилища можно было связать с запросом.
+// Должен стоять после chimiddleware.RequestID
+func LogHandle(logger zerolog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			ctx := logger.With().Str("request_id", chimiddleware.GetReqID(r.Context())).Logger().WithContext(r.Context())
+			// CheckTokenHandle дописывает user_id в этот же логгер
+			reqLogger := zerolog.Ctx(ctx)
+
+			ww := chimiddleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r.WithContext(ctx))
+
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			reqLogger.Info().
+				Str("method", r.Method).
+				Str("route", routePattern(r)).
+				Int("status", status).
+				Int("bytes", ww.BytesWritten()).
+				Dur("latency", time.Since(start)).
+				Msg("request")
+		})
+	}
+}
+
+// routePattern возвращает шаблон маршрута chi, чтобы в логи и метрики не попадали номера заказов.
+// Шаблон известен только после обработки запроса роутером
+func routePattern(r *http.Request) string {
+	if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+		return rctx.RoutePattern()
+	}
+
+	return r.URL.Path
+}
@@ -5,6 +5,10 @@ import (
 	"io"
 	"net/http"
 	"strings"
+
+	"internal/auth"
+
+	"github.com/rs/zerolog"
 )
 
 type gzipWriter struct {
@@ -63,19 +67,39 @@ func UnGzipHandle(next http.Handler) http.Handler {
 	})
 }
 
-func CheckCookieHandle(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.RequestURI != "/api/user/register" && r.RequestURI != "/api/user/login" {
-			headers := r.Header
-			_, ok := headers["Authorization"]
+// CheckTokenHandle проверяет токен из заголовка Authorization или из cookie
+// и кладёт id пользователя в контекст запроса
+func CheckTokenHandle(secret []byte) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/api/user/register" || r.URL.Path == "/api/user/login" {
+				next.ServeHTTP(w, r)
+				return
+			}
 
-			if !ok {
-				http.Error(w, "cookie not found", http.StatusUnauthorized)
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if token == "" {
+				if cookie, err := r.Cookie(auth.COOKIE_NAME); err == nil {
+					token = cookie.Value
+				}
+			}
+
+			if token == "" {
+				http.Error(w, "token not found", http.StatusUnauthorized)
 				return
 			}
-			next.ServeHTTP(w, r)
-		} else {
-			next.ServeHTTP(w, r)
-		}
-	})
+
+			userID, err := auth.ParseToken(token, secret)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+
+			zerolog.Ctx(r.Context()).UpdateContext(func(c zerolog.Context) zerolog.Context {
+				return c.Int("user_id", userID)
+			})
+
+			next.ServeHTTP(w, r.WithContext(auth.WithUserID(r.Context(), userID)))
+		})
+	}
 }
@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+var ErrSchemaDirty = errors.New("Database schema is dirty, last migration failed!")
+
+// Ping проверяет соединение с БД и то, что схема не старее последней вшитой миграции:
+// непримененные миграции, откат или упавшая миграция делают сервис неготовым. Более новая
+// схема допустима - её накатила новая реплика во время постепенного обновления
+func (d *DBController) Ping(ctx context.Context) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	if err := d.db.PingContext(ctx); err != nil {
+		return err
+	}
+
+	var version uint
+	var dirty bool
+	err := d.db.QueryRowContext(ctx, "SELECT version, dirty FROM schema_migrations").Scan(&version, &dirty)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("database schema is not migrated, expected version %d", d.schemaVersion)
+	}
+	if err != nil {
+		return err
+	}
+
+	if dirty {
+		return ErrSchemaDirty
+	}
+
+	if version < d.schemaVersion {
+		return fmt.Errorf("database schema version is %d, expected at least %d", version, d.schemaVersion)
+	}
+
+	return nil
+}
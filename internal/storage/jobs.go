@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// состояния задач проверки заказа в системе расчёта баллов
+const (
+	JOB_PENDING = "PENDING"
+	JOB_DONE    = "DONE"
+	JOB_DEAD    = "DEAD" // заказ слишком долго не обрабатывается системой расчёта, нужен разбор вручную
+)
+
+type AccrualJob struct {
+	OrderNumber string
+	OrderStatus OrderStatus
+	Attempts    int // запросов к системе расчёта, дошедших до неё
+	CreatedAt   time.Time
+}
+
+func (d *DBController) ClaimAccrualJobs(ctx context.Context, limit int, lease time.Duration) ([]AccrualJob, error) {
+	d.log(ctx).Trace().Msg("ClaimAccrualJobs func!")
+	var jobs []AccrualJob
+
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	// одним запросом блокируем свободные задачи и откладываем их на lease: другие реплики
+	// пропускают заблокированные строки, а после падения воркера задача вернётся в очередь.
+	// Аренда считается по часам БД, как и в TakeAccrualSlot: реплика с убежавшими вперёд часами
+	// иначе забрала бы задачу, которую ещё держит другая.
+	// Попытка засчитывается не здесь, а в RetryAccrualJob, когда запрос действительно отправлен
+	rows, err := d.db.QueryContext(ctx, `WITH claimed AS (
+											SELECT id FROM accrual_jobs WHERE state = $1 AND next_attempt_at <= now()
+											ORDER BY next_attempt_at LIMIT $2 FOR UPDATE SKIP LOCKED)
+										UPDATE accrual_jobs j SET next_attempt_at = now() + $3 * interval '1 millisecond', updated_at = now()
+										FROM claimed, orders o WHERE j.id = claimed.id AND o.number = j.order_number
+										RETURNING j.order_number, o.status, j.attempts, j.created_at`,
+		JOB_PENDING, limit, lease.Milliseconds())
+
+	if err != nil {
+		d.log(ctx).Error().Err(err).Msg("ClaimAccrualJobs: query failed")
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var j AccrualJob
+		err = rows.Scan(&j.OrderNumber, &j.OrderStatus, &j.Attempts, &j.CreatedAt)
+		if err != nil {
+			d.log(ctx).Error().Err(err).Msg("ClaimAccrualJobs: scan failed")
+			return nil, err
+		}
+
+		jobs = append(jobs, j)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		d.log(ctx).Error().Err(err).Msg("ClaimAccrualJobs: rows iteration failed")
+		return nil, err
+	}
+
+	return jobs, nil
+}
+
+func (d *DBController) RetryAccrualJob(ctx context.Context, number string, attempts int, delay time.Duration, lastErr string) error {
+	d.log(ctx).Trace().Msg("RetryAccrualJob func!")
+
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	_, err := d.db.ExecContext(ctx, `UPDATE accrual_jobs SET attempts = $1, next_attempt_at = now() + $2 * interval '1 millisecond',
+										last_error = NULLIF($3, ''), updated_at = now()
+										WHERE order_number = $4 AND state = $5`,
+		attempts, delay.Milliseconds(), lastErr, number, JOB_PENDING)
+
+	if err != nil {
+		d.log(ctx).Error().Err(err).Msg("RetryAccrualJob: exec failed")
+		return err
+	}
+
+	return nil
+}
+
+// ReleaseAccrualJobs снимает аренду с задач, до которых не дошла очередь воркера, не меняя
+// число попыток: иначе они ждали бы конца аренды и получали задержку, не будучи проверенными
+func (d *DBController) ReleaseAccrualJobs(ctx context.Context, numbers []string) error {
+	d.log(ctx).Trace().Msg("ReleaseAccrualJobs func!")
+
+	if len(numbers) == 0 {
+		return nil
+	}
+
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	// номера заказов состоят из цифр, поэтому передаём их одной строкой через запятую
+	_, err := d.db.ExecContext(ctx, `UPDATE accrual_jobs SET next_attempt_at = now(), updated_at = now()
+										WHERE order_number = ANY(string_to_array($1, ',')) AND state = $2`,
+		strings.Join(numbers, ","), JOB_PENDING)
+
+	if err != nil {
+		d.log(ctx).Error().Err(err).Msg("ReleaseAccrualJobs: exec failed")
+		return err
+	}
+
+	return nil
+}
+
+func (d *DBController) DeadAccrualJob(ctx context.Context, number string, reason string) error {
+	d.log(ctx).Trace().Msg("DeadAccrualJob func!")
+
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	_, err := d.db.ExecContext(ctx, `UPDATE accrual_jobs SET state = $1, last_error = $2, updated_at = $3
+										WHERE order_number = $4 AND state = $5`,
+		JOB_DEAD, reason, time.Now(), number, JOB_PENDING)
+
+	if err != nil {
+		d.log(ctx).Error().Err(err).Msg("DeadAccrualJob: exec failed")
+		return err
+	}
+
+	return nil
+}
+
+// finishAccrualJob закрывает задачу заказа, получившего окончательный статус
+func (d *DBController) finishAccrualJob(ctx context.Context, tx *sql.Tx, number string) error {
+	_, err := tx.ExecContext(ctx, `UPDATE accrual_jobs SET state = $1, updated_at = $2 WHERE order_number = $3 AND state = $4`,
+		JOB_DONE, time.Now(), number, JOB_PENDING)
+
+	if err != nil {
+		d.log(ctx).Error().Err(err).Msg("finishAccrualJob: exec failed")
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// виды проводок в журнале счёта баллов
+const (
+	LEDGER_ACCRUAL    = "ACCRUAL"
+	LEDGER_WITHDRAWAL = "WITHDRAWAL"
+)
+
+type LedgerEntry struct {
+	Order     string    `json:"order"`
+	Kind      string    `json:"kind"`
+	Amount    Money     `json:"amount"`  // начисления положительные, списания отрицательные
+	Balance   Money     `json:"balance"` // остаток после проводки
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (d *DBController) GetLedger(ctx context.Context, userId int) ([]LedgerEntry, error) {
+	d.log(ctx).Trace().Msg("GetLedger func!")
+	var entries []LedgerEntry
+
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := d.db.QueryContext(ctx, `SELECT order_number, kind, amount, SUM(amount) OVER (ORDER BY id), created_at
+											FROM ledger WHERE user_id = $1 ORDER BY id`,
+		userId)
+
+	if err != nil {
+		d.log(ctx).Error().Err(err).Msg("GetLedger: query failed")
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var e LedgerEntry
+		err = rows.Scan(&e.Order, &e.Kind, &e.Amount, &e.Balance, &e.CreatedAt)
+		if err != nil {
+			d.log(ctx).Error().Err(err).Msg("GetLedger: scan failed")
+			return nil, err
+		}
+
+		entries = append(entries, e)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		d.log(ctx).Error().Err(err).Msg("GetLedger: rows iteration failed")
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// addLedgerEntry записывает проводку в журнал и в той же транзакции обновляет снимок остатка в balance
+func (d *DBController) addLedgerEntry(ctx context.Context, tx *sql.Tx, userId int, number string, kind string, amount Money) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO ledger(user_id, order_number, kind, amount, created_at) VALUES($1,$2,$3,$4,$5)`,
+		userId, number, kind, amount, time.Now().Format(time.RFC3339))
+
+	if err != nil {
+		d.log(ctx).Error().Err(err).Msg("addLedgerEntry: exec failed")
+		return err
+	}
+
+	var withdrawn Money
+	if kind == LEDGER_WITHDRAWAL {
+		withdrawn = -amount
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO balance(user_id, current, withdrawn) VALUES($1,$2,$3)
+									ON CONFLICT (user_id) DO UPDATE SET current = balance.current + EXCLUDED.current,
+									withdrawn = balance.withdrawn + EXCLUDED.withdrawn`,
+		userId, amount, withdrawn)
+
+	if err != nil {
+		d.log(ctx).Error().Err(err).Msg("addLedgerEntry: exec failed")
+		return err
+	}
+
+	return nil
+}
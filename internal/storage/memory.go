@@ -0,0 +1,476 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+type memUser struct {
+	id       int
+	login    string
+	password string
+}
+
+type memOrder struct {
+	userId  int
+	order   Order
+	history []StatusChange
+}
+
+type memJob struct {
+	job           AccrualJob
+	state         string
+	nextAttemptAt time.Time
+	lastError     string
+}
+
+type memLedgerEntry struct {
+	userId int
+	entry  LedgerEntry
+}
+
+// MemController реализует StorageController в памяти процесса. Используется в тестах
+// и для локального запуска без PostgreSQL
+type MemController struct {
+	mu              sync.RWMutex
+	users           map[string]*memUser  // по логину
+	orders          map[string]*memOrder // по номеру заказа
+	withdrawals     map[string]int       // номер заказа -> id пользователя, оплатившего его баллами
+	userWithdrawals map[int][]WithDrawal
+	balances        map[int]*UserBalance
+	jobs            map[string]*memJob // по номеру заказа
+	ledger          []memLedgerEntry
+	accrualLimit    memRateLimit
+	logger          zerolog.Logger
+}
+
+type memRateLimit struct {
+	nextSlot    time.Time
+	pausedUntil time.Time
+	interval    time.Duration
+}
+
+func NewMemController(logger zerolog.Logger) *MemController {
+	return &MemController{
+		users:           make(map[string]*memUser),
+		orders:          make(map[string]*memOrder),
+		withdrawals:     make(map[string]int),
+		userWithdrawals: make(map[int][]WithDrawal),
+		balances:        make(map[int]*UserBalance),
+		jobs:            make(map[string]*memJob),
+		logger:          logger,
+	}
+}
+
+func (m *MemController) IsUserExist(ctx context.Context, login string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, ok := m.users[login]
+	return ok, nil
+}
+
+func (m *MemController) IsUserValid(ctx context.Context, user UserInfo) (int, error) {
+	m.mu.RLock()
+	u, ok := m.users[user.Login]
+	m.mu.RUnlock()
+
+	if !ok {
+		checkPassword(string(dummyHash), user.Password)
+		return 0, ErrWrongCredentials
+	}
+
+	if ok, _ := checkPassword(u.password, user.Password); !ok {
+		return 0, ErrWrongCredentials
+	}
+
+	return u.id, nil
+}
+
+func (m *MemController) AddUser(ctx context.Context, user UserInfo) (int, error) {
+	if err := user.Validate(); err != nil {
+		return 0, err
+	}
+
+	password, err := hashPassword(user.Password)
+
+	if err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[user.Login]; ok {
+		return 0, ErrUserExists
+	}
+
+	u := &memUser{
+		id:       len(m.users) + 1,
+		login:    user.Login,
+		password: password,
+	}
+	m.users[user.Login] = u
+	m.balances[u.id] = &UserBalance{}
+
+	return u.id, nil
+}
+
+func (m *MemController) AddOrder(ctx context.Context, userId int, number string) (AddOrderReturn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if o, ok := m.orders[number]; ok {
+		if o.userId != userId {
+			return ALREADY_MADE_BY_ANOTHER_USER, nil
+		}
+		return ALREADY_MADE_BY_USER, nil
+	}
+
+	now := time.Now()
+	m.orders[number] = &memOrder{
+		userId: userId,
+		order: Order{
+			Number:     number,
+			Status:     STATUS_NEW,
+			UploadedAt: now,
+		},
+		history: []StatusChange{{To: STATUS_NEW, Source: SOURCE_UPLOAD, At: now}},
+	}
+	m.jobs[number] = &memJob{
+		job:           AccrualJob{OrderNumber: number, CreatedAt: now},
+		state:         JOB_PENDING,
+		nextAttemptAt: now,
+	}
+
+	return ADDED, nil
+}
+
+func (m *MemController) GetOrders(ctx context.Context, userId int, filter ListFilter) (Orders, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	orders := &Orders{}
+	for _, o := range m.orders {
+		if o.userId != userId || filter.Status != "" && o.order.Status != filter.Status {
+			continue
+		}
+		if filter.match(o.order.UploadedAt) && filter.Cursor.after(o.order.UploadedAt, o.order.Number) {
+			orders.Orders = append(orders.Orders, o.order)
+		}
+	}
+
+	sortOrdersByTime(orders)
+
+	if filter.Limit > 0 && len(orders.Orders) > filter.Limit {
+		orders.Orders = orders.Orders[:filter.Limit]
+		last := orders.Orders[filter.Limit-1]
+		orders.Next = &Cursor{Time: last.UploadedAt, Number: last.Number}
+	}
+
+	return *orders, nil
+}
+
+func (m *MemController) GetBalance(ctx context.Context, userId int) (UserBalance, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if b, ok := m.balances[userId]; ok {
+		return *b, nil
+	}
+
+	return UserBalance{}, nil
+}
+
+func (m *MemController) GetWithdrawals(ctx context.Context, userId int, filter ListFilter) (WithDrawals, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	withdrawals := &WithDrawals{}
+	for _, w := range m.userWithdrawals[userId] {
+		if filter.match(w.ProcessedAt) && filter.Cursor.after(w.ProcessedAt, w.Order) {
+			withdrawals.WithDrawals = append(withdrawals.WithDrawals, w)
+		}
+	}
+
+	sortWithDrawalsByTime(withdrawals)
+
+	if filter.Limit > 0 && len(withdrawals.WithDrawals) > filter.Limit {
+		withdrawals.WithDrawals = withdrawals.WithDrawals[:filter.Limit]
+		last := withdrawals.WithDrawals[filter.Limit-1]
+		withdrawals.Next = &Cursor{Time: last.ProcessedAt, Number: last.Order}
+	}
+
+	return *withdrawals, nil
+}
+
+func (m *MemController) WithdrawBalance(ctx context.Context, userId int, withdrawal WithDrawal) error {
+	if withdrawal.Sum <= 0 {
+		return ErrInvalidWithdrawalSum
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if ownerId, ok := m.withdrawals[withdrawal.Order]; ok {
+		if ownerId == userId {
+			for _, w := range m.userWithdrawals[userId] {
+				if w.Order == withdrawal.Order && w.Sum == withdrawal.Sum {
+					return nil
+				}
+			}
+		}
+		return ErrOrderAlreadyWithdrawn
+	}
+
+	b := m.balance(userId)
+	if b.Current < withdrawal.Sum {
+		return ErrNotEnoughBalance
+	}
+
+	withdrawal.ProcessedAt = time.Now()
+	m.withdrawals[withdrawal.Order] = userId
+	m.userWithdrawals[userId] = append(m.userWithdrawals[userId], withdrawal)
+	m.addLedgerEntry(userId, withdrawal.Order, LEDGER_WITHDRAWAL, -withdrawal.Sum)
+
+	return nil
+}
+
+func (m *MemController) UpdateOrderStatus(ctx context.Context, number string, status OrderStatus, accrual *Money, source string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	o, ok := m.orders[number]
+	if !ok {
+		return ErrOrderNotFound
+	}
+	if o.order.Status == status {
+		return nil
+	}
+
+	if err := Transition(o.order.Status, status); err != nil {
+		return err
+	}
+
+	o.history = append(o.history, StatusChange{From: o.order.Status, To: status, Source: source, At: time.Now()})
+	o.order.Status = status
+	o.order.Accrual = nil
+	if accrual != nil {
+		a := *accrual
+		o.order.Accrual = &a
+	}
+
+	if j, ok := m.jobs[number]; ok && status.Final() && j.state == JOB_PENDING {
+		j.state = JOB_DONE
+	}
+
+	if status == STATUS_PROCESSED && accrual != nil {
+		m.addLedgerEntry(o.userId, number, LEDGER_ACCRUAL, *accrual)
+	}
+
+	return nil
+}
+
+func (m *MemController) GetOrderTimeline(ctx context.Context, userId int, number string) (OrderTimeline, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	o, ok := m.orders[number]
+	if !ok || o.userId != userId {
+		return OrderTimeline{}, ErrOrderNotFound
+	}
+
+	timeline := OrderTimeline{Order: o.order}
+	timeline.History = append(timeline.History, o.history...)
+
+	return timeline, nil
+}
+
+func (m *MemController) GetLedger(ctx context.Context, userId int) ([]LedgerEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var entries []LedgerEntry
+	var balance Money
+	for _, e := range m.ledger {
+		if e.userId == userId {
+			balance += e.entry.Amount
+			entry := e.entry
+			entry.Balance = balance
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, nil
+}
+
+func (m *MemController) GetStats(ctx context.Context) (Stats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	stats := Stats{OrdersByStatus: make(map[OrderStatus]int), JobsByState: make(map[string]int)}
+	for _, o := range m.orders {
+		stats.OrdersByStatus[o.order.Status]++
+	}
+
+	for _, j := range m.jobs {
+		stats.JobsByState[j.state]++
+	}
+
+	for _, e := range m.ledger {
+		switch e.entry.Kind {
+		case LEDGER_ACCRUAL:
+			stats.Accrued += e.entry.Amount
+		case LEDGER_WITHDRAWAL:
+			stats.Withdrawn -= e.entry.Amount
+		}
+	}
+
+	return stats, nil
+}
+
+func (m *MemController) ClaimAccrualJobs(ctx context.Context, limit int, lease time.Duration) ([]AccrualJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var ready []*memJob
+	for _, j := range m.jobs {
+		if j.state == JOB_PENDING && !j.nextAttemptAt.After(now) {
+			ready = append(ready, j)
+		}
+	}
+
+	sort.Slice(ready, func(i, k int) bool {
+		return ready[i].nextAttemptAt.Before(ready[k].nextAttemptAt)
+	})
+	if len(ready) > limit {
+		ready = ready[:limit]
+	}
+
+	jobs := make([]AccrualJob, 0, len(ready))
+	for _, j := range ready {
+		j.nextAttemptAt = now.Add(lease)
+
+		job := j.job
+		job.OrderStatus = m.orders[job.OrderNumber].order.Status
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
+func (m *MemController) RetryAccrualJob(ctx context.Context, number string, attempts int, delay time.Duration, lastErr string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if j, ok := m.jobs[number]; ok && j.state == JOB_PENDING {
+		j.job.Attempts = attempts
+		j.nextAttemptAt = time.Now().Add(delay)
+		j.lastError = lastErr
+	}
+
+	return nil
+}
+
+func (m *MemController) ReleaseAccrualJobs(ctx context.Context, numbers []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for _, number := range numbers {
+		if j, ok := m.jobs[number]; ok && j.state == JOB_PENDING {
+			j.nextAttemptAt = now
+		}
+	}
+
+	return nil
+}
+
+func (m *MemController) DeadAccrualJob(ctx context.Context, number string, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if j, ok := m.jobs[number]; ok && j.state == JOB_PENDING {
+		j.state = JOB_DEAD
+		j.lastError = reason
+	}
+
+	return nil
+}
+
+func (m *MemController) TakeAccrualSlot(ctx context.Context) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	l := &m.accrualLimit
+	allowedAt := l.nextSlot
+	if l.pausedUntil.After(allowedAt) {
+		allowedAt = l.pausedUntil
+	}
+
+	now := time.Now()
+	if allowedAt.After(now) {
+		return allowedAt.Sub(now), nil
+	}
+
+	l.nextSlot = now.Add(l.interval)
+	return 0, nil
+}
+
+func (m *MemController) PauseAccrual(ctx context.Context, pause time.Duration, interval time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	l := &m.accrualLimit
+	if until := time.Now().Add(pause); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+	if interval > 0 {
+		l.interval = interval
+	}
+
+	return nil
+}
+
+func (m *MemController) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *MemController) Close() error {
+	return nil
+}
+
+// balance возвращает остаток пользователя, создавая его при первом обращении. Вызывается под m.mu
+func (m *MemController) balance(userId int) *UserBalance {
+	b, ok := m.balances[userId]
+	if !ok {
+		b = &UserBalance{}
+		m.balances[userId] = b
+	}
+
+	return b
+}
+
+// addLedgerEntry записывает проводку и обновляет остаток. Вызывается под m.mu
+func (m *MemController) addLedgerEntry(userId int, number string, kind string, amount Money) {
+	m.ledger = append(m.ledger, memLedgerEntry{
+		userId: userId,
+		entry: LedgerEntry{
+			Order:     number,
+			Kind:      kind,
+			Amount:    amount,
+			CreatedAt: time.Now(),
+		},
+	})
+
+	b := m.balance(userId)
+	b.Current += amount
+	if kind == LEDGER_WITHDRAWAL {
+		b.Withdrawn -= amount
+	}
+}
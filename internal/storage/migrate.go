@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"io/fs"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+)
+
+// NewMigrate открывает отдельное соединение с БД для управления миграциями из migrations.
+// Close у результата закрывает и соединение
+func NewMigrate(dsn string, migrations fs.FS) (*migrate.Migrate, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := newMigrate(db, migrations)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func newMigrate(db *sql.DB, migrations fs.FS) (*migrate.Migrate, error) {
+	source, err := iofs.New(migrations, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	driver, err := postgres.WithInstance(db, &postgres.Config{})
+	if err != nil {
+		return nil, err
+	}
+
+	return migrate.NewWithInstance("iofs", source, "pgx", driver)
+}
+
+// latestVersion возвращает номер последней миграции - версию схемы, с которой работает этот бинарник
+func latestVersion(migrations fs.FS) (uint, error) {
+	source, err := iofs.New(migrations, ".")
+	if err != nil {
+		return 0, err
+	}
+	defer source.Close()
+
+	version, err := source.First()
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		next, err := source.Next(version)
+		if errors.Is(err, fs.ErrNotExist) {
+			return version, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		version = next
+	}
+}
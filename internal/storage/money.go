@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidMoney = errors.New("Amount is not valid!")
+
+// Money - сумма баллов в копейках (1 балл = 1 рубль). Целое число копеек
+// не теряет точность при многократных начислениях и списаниях
+type Money int64
+
+var hundred = big.NewRat(100, 1)
+
+// ParseMoney разбирает десятичную запись суммы: "500", "500.5", "-0.01", а также
+// формат с экспонентой "50050e-2", в котором pgx отдаёт значения numeric
+func ParseMoney(s string) (Money, error) {
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok {
+		return 0, ErrInvalidMoney
+	}
+
+	r.Mul(r, hundred)
+	if !r.IsInt() || !r.Num().IsInt64() {
+		return 0, ErrInvalidMoney
+	}
+
+	return Money(r.Num().Int64()), nil
+}
+
+// String возвращает сумму без лишних нулей: 50050 -> "500.5", 4200 -> "42"
+func (m Money) String() string {
+	sign := ""
+	v := int64(m)
+	if v < 0 {
+		sign = "-"
+		v = -v
+	}
+
+	units, cents := v/100, v%100
+	switch {
+	case cents == 0:
+		return sign + strconv.FormatInt(units, 10)
+	case cents%10 == 0:
+		return fmt.Sprintf("%s%d.%d", sign, units, cents/10)
+	default:
+		return fmt.Sprintf("%s%d.%02d", sign, units, cents)
+	}
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *Money) UnmarshalJSON(data []byte) error {
+	v, err := ParseMoney(strings.Trim(string(data), `"`))
+	if err != nil {
+		return err
+	}
+
+	*m = v
+	return nil
+}
+
+// Scan читает значение столбца numeric
+func (m *Money) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*m = 0
+		return nil
+	case string:
+		return m.scanString(v)
+	case []byte:
+		return m.scanString(string(v))
+	case int64:
+		*m = Money(v * 100)
+		return nil
+	case float64:
+		*m = Money(math.Round(v * 100))
+		return nil
+	}
+
+	return fmt.Errorf("cannot scan %T into Money", src)
+}
+
+func (m *Money) scanString(s string) error {
+	v, err := ParseMoney(s)
+	if err != nil {
+		return err
+	}
+
+	*m = v
+	return nil
+}
+
+// Value передаёт сумму в запрос как точную десятичную строку
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
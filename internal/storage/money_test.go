@@ -0,0 +1,139 @@
+package storage_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"internal/storage"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    storage.Money
+		wantErr bool
+	}{
+		{in: "500", want: 50000},
+		{in: "500.5", want: 50050},
+		{in: "500.50", want: 50050},
+		{in: "0.01", want: 1},
+		{in: "-0.01", want: -1},
+		{in: "-100", want: -10000},
+		{in: " 42 ", want: 4200},
+		{in: "50050e-2", want: 50050}, // так pgx отдаёт numeric
+		{in: "5e2", want: 50000},
+		{in: "92233720368547758.07", want: 9223372036854775807},
+		{in: "0.001", wantErr: true},
+		{in: "1.005", wantErr: true},
+		{in: "92233720368547758.08", wantErr: true},
+		{in: "1e20", wantErr: true},
+		{in: "", wantErr: true},
+		{in: "abc", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := storage.ParseMoney(tt.in)
+
+			if tt.wantErr {
+				if !errors.Is(err, storage.ErrInvalidMoney) {
+					t.Errorf("got %d, %v, want %v", got, err, storage.ErrInvalidMoney)
+				}
+				return
+			}
+
+			if err != nil || got != tt.want {
+				t.Errorf("got %d, %v, want %d", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	tests := []struct {
+		in   storage.Money
+		want string
+	}{
+		{in: 0, want: "0"},
+		{in: 1, want: "0.01"},
+		{in: 4200, want: "42"},
+		{in: 50050, want: "500.5"},
+		{in: 12345, want: "123.45"},
+		{in: -5, want: "-0.05"},
+		{in: -50050, want: "-500.5"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := tt.in.String(); got != tt.want {
+				t.Errorf("String: got %s, want %s", got, tt.want)
+			}
+
+			body, err := json.Marshal(tt.in)
+			if err != nil || string(body) != tt.want {
+				t.Errorf("MarshalJSON: got %s, %v, want %s", body, err, tt.want)
+			}
+
+			// значение, отданное в JSON, читается обратно без потерь
+			var back storage.Money
+			if err := json.Unmarshal(body, &back); err != nil || back != tt.in {
+				t.Errorf("UnmarshalJSON: got %d, %v, want %d", back, err, tt.in)
+			}
+		})
+	}
+}
+
+func TestMoneyUnmarshalJSON(t *testing.T) {
+	var w storage.WithDrawal
+	if err := json.Unmarshal([]byte(`{"order":"1","sum":"100.25"}`), &w); err != nil || w.Sum != 10025 {
+		t.Errorf("quoted sum: got %d, %v, want 10025", w.Sum, err)
+	}
+
+	if err := json.Unmarshal([]byte(`{"order":"1","sum":0.001}`), &w); err == nil {
+		t.Error("sub-cent sum: got no error")
+	}
+}
+
+func TestMoneyScan(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     interface{}
+		want    storage.Money
+		wantErr bool
+	}{
+		{name: "bytes", src: []byte("500.50"), want: 50050},
+		{name: "pgx numeric", src: "50050e-2", want: 50050},
+		{name: "string", src: "42", want: 4200},
+		{name: "int64", src: int64(7), want: 700},
+		{name: "float64", src: float64(0.29), want: 29},
+		{name: "nil", src: nil, want: 0},
+		{name: "sub-cent", src: "0.001", wantErr: true},
+		{name: "unsupported type", src: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := storage.Money(12345)
+			err := m.Scan(tt.src)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got %d, want error", m)
+				}
+				return
+			}
+
+			if err != nil || m != tt.want {
+				t.Errorf("got %d, %v, want %d", m, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMoneyValue(t *testing.T) {
+	v, err := storage.Money(-50050).Value()
+	if err != nil || v != "-500.5" {
+		t.Errorf("got %v, %v, want -500.5", v, err)
+	}
+}
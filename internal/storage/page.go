@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidCursor = errors.New("Cursor is not valid!")
+
+// ListFilter - параметры выборки заказов и списаний. Нулевое значение возвращает
+// все записи пользователя, как того требует спецификация
+type ListFilter struct {
+	Limit  int         // 0 - без ограничения
+	Cursor *Cursor     // продолжить после этой записи
+	Status OrderStatus // только для заказов, пустая строка - любой статус
+	From   time.Time
+	To     time.Time // не включительно
+}
+
+// Cursor указывает на последнюю отданную запись. Записи отсортированы по времени
+// от старых к новым, номер заказа уникален и разрешает совпадения по времени
+type Cursor struct {
+	Time   time.Time
+	Number string
+}
+
+func (c Cursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.Time.Format(time.RFC3339Nano) + "|" + c.Number))
+}
+
+func ParseCursor(s string) (Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+
+	parts := strings.SplitN(string(raw), "|", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return Cursor{}, ErrInvalidCursor
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+
+	return Cursor{Time: t, Number: parts[1]}, nil
+}
+
+// after сообщает, идёт ли запись (t, number) после курсора в порядке выдачи
+func (c *Cursor) after(t time.Time, number string) bool {
+	if c == nil {
+		return true
+	}
+
+	return t.After(c.Time) || t.Equal(c.Time) && number > c.Number
+}
+
+// match проверяет время записи на попадание в [From, To)
+func (f ListFilter) match(t time.Time) bool {
+	return (f.From.IsZero() || !t.Before(f.From)) && (f.To.IsZero() || t.Before(f.To))
+}
+
+// where дописывает к запросу условия фильтра. timeColumn и numberColumn задают
+// столбцы, по которым отсортирована выборка
+func (f ListFilter) where(query string, args []interface{}, timeColumn, numberColumn string) (string, []interface{}) {
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if f.Status != "" {
+		query += " AND status = " + arg(f.Status)
+	}
+	if !f.From.IsZero() {
+		query += " AND " + timeColumn + " >= " + arg(f.From)
+	}
+	if !f.To.IsZero() {
+		query += " AND " + timeColumn + " < " + arg(f.To)
+	}
+	if f.Cursor != nil {
+		query += " AND (" + timeColumn + ", " + numberColumn + ") > (" + arg(f.Cursor.Time) + ", " + arg(f.Cursor.Number) + ")"
+	}
+
+	query += " ORDER BY " + timeColumn + ", " + numberColumn
+
+	// одна лишняя строка показывает, есть ли следующая страница
+	if f.Limit > 0 {
+		query += " LIMIT " + arg(f.Limit+1)
+	}
+
+	return query, args
+}
@@ -0,0 +1,39 @@
+package storage
+
+import (
+	"crypto/subtle"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const passwordCost = bcrypt.DefaultCost
+
+// dummyHash сравнивается с паролем, когда пользователь не найден,
+// чтобы время ответа не выдавало существование логина
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("gophermart"), passwordCost)
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+// checkPassword сравнивает пароль с хранимым значением. needRehash означает, что хранимое значение
+// нужно перезаписать: это пароль открытым текстом из старых записей или хеш с устаревшей стоимостью
+func checkPassword(stored string, password string) (ok bool, needRehash bool) {
+	cost, err := bcrypt.Cost([]byte(stored))
+
+	if err != nil {
+		ok = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+		return ok, ok
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) != nil {
+		return false, false
+	}
+
+	return true, cost != passwordCost
+}
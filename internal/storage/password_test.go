@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCheckPassword(t *testing.T) {
+	current, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cheap, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		stored         string
+		password       string
+		wantOk         bool
+		wantNeedRehash bool
+	}{
+		{name: "plaintext", stored: "secret", password: "secret", wantOk: true, wantNeedRehash: true},
+		{name: "plaintext wrong password", stored: "secret", password: "wrong", wantOk: false, wantNeedRehash: false},
+		{name: "plaintext prefix", stored: "secret", password: "secre", wantOk: false, wantNeedRehash: false},
+		{name: "lower cost hash", stored: string(cheap), password: "secret", wantOk: true, wantNeedRehash: true},
+		{name: "lower cost hash wrong password", stored: string(cheap), password: "wrong", wantOk: false, wantNeedRehash: false},
+		{name: "current cost hash", stored: current, password: "secret", wantOk: true, wantNeedRehash: false},
+		{name: "current cost hash wrong password", stored: current, password: "wrong", wantOk: false, wantNeedRehash: false},
+		// хеш, введённый как пароль, не совпадает с самим хешем
+		{name: "hash as password", stored: current, password: current, wantOk: false, wantNeedRehash: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, needRehash := checkPassword(tt.stored, tt.password)
+
+			if ok != tt.wantOk || needRehash != tt.wantNeedRehash {
+				t.Errorf("got ok=%t needRehash=%t, want ok=%t needRehash=%t", ok, needRehash, tt.wantOk, tt.wantNeedRehash)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// TakeAccrualSlot занимает слот для запроса к системе расчёта баллов, общий для всех реплик.
+// Возвращает 0, если слот занят и запрос можно делать сразу, иначе - сколько подождать
+// перед следующей попыткой. Время берётся из БД, чтобы не зависеть от расхождения часов реплик
+func (d *DBController) TakeAccrualSlot(ctx context.Context) (time.Duration, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	var waitMs int64
+	row := d.db.QueryRowContext(ctx, `WITH old AS (
+											SELECT GREATEST(next_slot, paused_until) AS allowed_at FROM accrual_rate_limit WHERE id = 1 FOR UPDATE)
+										UPDATE accrual_rate_limit l SET next_slot = CASE WHEN old.allowed_at <= now()
+											THEN now() + l.interval_ms * interval '1 millisecond' ELSE l.next_slot END
+										FROM old WHERE l.id = 1
+										RETURNING GREATEST(0, CEIL(EXTRACT(EPOCH FROM old.allowed_at - now()) * 1000))::bigint`)
+	err := row.Scan(&waitMs)
+
+	if err != nil {
+		d.log(ctx).Error().Err(err).Msg("TakeAccrualSlot: query failed")
+		return 0, err
+	}
+
+	return time.Duration(waitMs) * time.Millisecond, nil
+}
+
+// PauseAccrual откладывает запросы всех реплик на d. Если interval > 0, после паузы
+// запросы идут не чаще одного в interval
+func (d *DBController) PauseAccrual(ctx context.Context, pause time.Duration, interval time.Duration) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	_, err := d.db.ExecContext(ctx, `UPDATE accrual_rate_limit SET
+										paused_until = GREATEST(paused_until, now() + $1 * interval '1 millisecond'),
+										interval_ms = CASE WHEN $2 > 0 THEN $2 ELSE interval_ms END
+										WHERE id = 1`,
+		pause.Milliseconds(), interval.Milliseconds())
+
+	if err != nil {
+		d.log(ctx).Error().Err(err).Msg("PauseAccrual: exec failed")
+		return err
+	}
+
+	return nil
+}
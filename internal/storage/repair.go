@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"context"
+)
+
+// RepairBalances создаёт недостающие строки balance для пользователей, зарегистрированных
+// до того, как AddUser стал создавать их сам. Остаток считается по журналу проводок.
+// Возвращает число созданных строк
+func (d *DBController) RepairBalances(ctx context.Context) (int64, error) {
+	res, err := d.db.ExecContext(ctx, `INSERT INTO balance (user_id, current, withdrawn)
+										SELECT users.id,
+											COALESCE(SUM(ledger.amount), 0),
+											COALESCE(-SUM(ledger.amount) FILTER (WHERE ledger.kind = $1), 0)
+										FROM users LEFT JOIN ledger ON ledger.user_id = users.id
+										WHERE NOT EXISTS (SELECT 1 FROM balance WHERE balance.user_id = users.id)
+										GROUP BY users.id
+										ON CONFLICT (user_id) DO NOTHING`,
+		LEDGER_WITHDRAWAL)
+
+	if err != nil {
+		d.log(ctx).Error().Err(err).Msg("RepairBalances: exec failed")
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"context"
+)
+
+// Stats - агрегаты по всем пользователям для метрик
+type Stats struct {
+	OrdersByStatus map[OrderStatus]int
+	JobsByState    map[string]int // задачи проверки в системе расчёта баллов
+	Accrued        Money
+	Withdrawn      Money
+}
+
+func (d *DBController) GetStats(ctx context.Context) (Stats, error) {
+	d.log(ctx).Trace().Msg("GetStats func!")
+
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	stats := Stats{OrdersByStatus: make(map[OrderStatus]int), JobsByState: make(map[string]int)}
+
+	rows, err := d.db.QueryContext(ctx, "SELECT status, COUNT(*) FROM orders GROUP BY status")
+
+	if err != nil {
+		d.log(ctx).Error().Err(err).Msg("GetStats: query failed")
+		return Stats{}, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var status OrderStatus
+		var count int
+		err = rows.Scan(&status, &count)
+		if err != nil {
+			d.log(ctx).Error().Err(err).Msg("GetStats: scan failed")
+			return Stats{}, err
+		}
+
+		stats.OrdersByStatus[status] = count
+	}
+
+	err = rows.Err()
+	if err != nil {
+		d.log(ctx).Error().Err(err).Msg("GetStats: rows iteration failed")
+		return Stats{}, err
+	}
+
+	rows, err = d.db.QueryContext(ctx, "SELECT state, COUNT(*) FROM accrual_jobs GROUP BY state")
+
+	if err != nil {
+		d.log(ctx).Error().Err(err).Msg("GetStats: query failed")
+		return Stats{}, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var state string
+		var count int
+		err = rows.Scan(&state, &count)
+		if err != nil {
+			d.log(ctx).Error().Err(err).Msg("GetStats: scan failed")
+			return Stats{}, err
+		}
+
+		stats.JobsByState[state] = count
+	}
+
+	err = rows.Err()
+	if err != nil {
+		d.log(ctx).Error().Err(err).Msg("GetStats: rows iteration failed")
+		return Stats{}, err
+	}
+
+	row := d.db.QueryRowContext(ctx, `SELECT COALESCE(SUM(amount) FILTER (WHERE kind = $1), 0),
+											COALESCE(-SUM(amount) FILTER (WHERE kind = $2), 0) FROM ledger`,
+		LEDGER_ACCRUAL, LEDGER_WITHDRAWAL)
+	err = row.Scan(&stats.Accrued, &stats.Withdrawn)
+
+	if err != nil {
+		d.log(ctx).Error().Err(err).Msg("GetStats: query failed")
+		return Stats{}, err
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"time"
+)
+
+var ErrInvalidTransition = errors.New("Order status transition is not allowed!")
+var ErrOrderNotFound = errors.New("Order not found!")
+
+// OrderStatus - статус заказа в системе лояльности
+type OrderStatus string
+
+const (
+	STATUS_NEW        OrderStatus = "NEW"
+	STATUS_PROCESSING OrderStatus = "PROCESSING"
+	STATUS_INVALID    OrderStatus = "INVALID"
+	STATUS_PROCESSED  OrderStatus = "PROCESSED"
+)
+
+// источники смены статуса в истории заказа
+const (
+	SOURCE_UPLOAD   = "UPLOAD"   // пользователь загрузил заказ
+	SOURCE_POLLING  = "POLLING"  // воркер опросил систему расчёта
+	SOURCE_CALLBACK = "CALLBACK" // уведомление от системы расчёта
+	SOURCE_BACKFILL = "BACKFILL" // переход восстановлен миграцией для заказов, загруженных до появления истории
+)
+
+// transitions - разрешённые переходы: из NEW и PROCESSING можно уйти в любой следующий статус,
+// INVALID и PROCESSED окончательные
+var transitions = map[OrderStatus][]OrderStatus{
+	STATUS_NEW:        {STATUS_PROCESSING, STATUS_INVALID, STATUS_PROCESSED},
+	STATUS_PROCESSING: {STATUS_INVALID, STATUS_PROCESSED},
+}
+
+func (s OrderStatus) Valid() bool {
+	switch s {
+	case STATUS_NEW, STATUS_PROCESSING, STATUS_INVALID, STATUS_PROCESSED:
+		return true
+	}
+	return false
+}
+
+// Final сообщает, что заказ больше не нужно проверять в системе расчёта
+func (s OrderStatus) Final() bool {
+	return s == STATUS_INVALID || s == STATUS_PROCESSED
+}
+
+// Transition проверяет переход from -> to. Переход в тот же статус не считается переходом
+// и тоже возвращает ErrInvalidTransition, вызывающий код обрабатывает его как повтор
+func Transition(from, to OrderStatus) error {
+	for _, allowed := range transitions[from] {
+		if allowed == to {
+			return nil
+		}
+	}
+
+	return ErrInvalidTransition
+}
+
+func (s OrderStatus) Value() (driver.Value, error) {
+	return string(s), nil
+}
+
+// StatusChange - запись истории статусов заказа. From пустой у первой записи
+type StatusChange struct {
+	From   OrderStatus `json:"from,omitempty"`
+	To     OrderStatus `json:"to"`
+	Source string      `json:"source"`
+	At     time.Time   `json:"at"`
+}
+
+type OrderTimeline struct {
+	Order
+	History []StatusChange `json:"history"`
+}
+
+// GetOrderTimeline возвращает заказ пользователя с историей статусов. Чужой или
+// несуществующий заказ - ErrOrderNotFound
+func (d *DBController) GetOrderTimeline(ctx context.Context, userId int, number string) (OrderTimeline, error) {
+	d.log(ctx).Trace().Msg("GetOrderTimeline func!")
+	var timeline OrderTimeline
+
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	row := d.db.QueryRowContext(ctx, "SELECT number, status, accrual, uploaded_at FROM orders WHERE number = $1 AND user_id = $2",
+		number, userId)
+	err := row.Scan(&timeline.Number, &timeline.Status, &timeline.Accrual, &timeline.UploadedAt)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return OrderTimeline{}, ErrOrderNotFound
+	}
+
+	if err != nil {
+		d.log(ctx).Error().Err(err).Msg("GetOrderTimeline: query failed")
+		return OrderTimeline{}, err
+	}
+
+	rows, err := d.db.QueryContext(ctx, `SELECT from_status, to_status, source, created_at FROM order_status_history
+											WHERE order_number = $1 ORDER BY id`,
+		number)
+
+	if err != nil {
+		d.log(ctx).Error().Err(err).Msg("GetOrderTimeline: query failed")
+		return OrderTimeline{}, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var c StatusChange
+		var from sql.NullString
+		err = rows.Scan(&from, &c.To, &c.Source, &c.At)
+		if err != nil {
+			d.log(ctx).Error().Err(err).Msg("GetOrderTimeline: scan failed")
+			return OrderTimeline{}, err
+		}
+
+		c.From = OrderStatus(from.String)
+		timeline.History = append(timeline.History, c)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		d.log(ctx).Error().Err(err).Msg("GetOrderTimeline: rows iteration failed")
+		return OrderTimeline{}, err
+	}
+
+	return timeline, nil
+}
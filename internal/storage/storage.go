@@ -4,18 +4,23 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"io/fs"
 	"sort"
-	"strconv"
 	"time"
+	"unicode/utf8"
 
 	"github.com/golang-migrate/migrate/v4"
-	"github.com/golang-migrate/migrate/v4/database/postgres"
-	_ "github.com/golang-migrate/migrate/v4/database/postgres"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/jackc/pgx"
 	"github.com/rs/zerolog"
 )
 
 var ErrNotEnoughBalance = errors.New("Current balance is not enough!")
+var ErrWrongCredentials = errors.New("Username or password wrong!")
+var ErrOrderAlreadyWithdrawn = errors.New("Order already paid with points!")
+var ErrUserExists = errors.New("User already exist!")
+var ErrEmptyCredentials = errors.New("Login and password must not be empty!")
+var ErrCredentialsTooLong = errors.New("Login or password is too long!")
+var ErrInvalidWithdrawalSum = errors.New("Withdrawal sum must be positive!")
 
 type AddOrderReturn int
 
@@ -26,86 +31,147 @@ const (
 	ERROR
 )
 
+const (
+	MAX_LOGIN_LENGTH    = 50 // символов, столбец users.login - varchar(50)
+	MAX_PASSWORD_LENGTH = 72 // байт, дальше bcrypt пароль не учитывает
+)
+
 type UserInfo struct {
 	Login    string `json:"login"`
 	Password string `json:"password"`
 }
 
+func (u UserInfo) Validate() error {
+	if u.Login == "" || u.Password == "" {
+		return ErrEmptyCredentials
+	}
+
+	if utf8.RuneCountInString(u.Login) > MAX_LOGIN_LENGTH || len(u.Password) > MAX_PASSWORD_LENGTH {
+		return ErrCredentialsTooLong
+	}
+
+	return nil
+}
+
 type UserBalance struct {
-	Current   float64 `json:"current"`
-	Withdrawn float64 `json:"withdrawn"`
+	Current   Money `json:"current"`
+	Withdrawn Money `json:"withdrawn"`
 }
 
 type Order struct {
-	Number     string    `json:"number"`
-	Status     string    `json:"status"`
-	Accrual    *float64  `json:"accrual,omitempty"`
-	UploadedAt time.Time `json:"uploaded_at"`
+	Number     string      `json:"number"`
+	Status     OrderStatus `json:"status"`
+	Accrual    *Money      `json:"accrual,omitempty"`
+	UploadedAt time.Time   `json:"uploaded_at"`
 }
 
 type Orders struct {
 	Orders []Order `json:"orders"`
+	Next   *Cursor `json:"-"` // nil, если это последняя страница
 }
 
 type WithDrawal struct {
 	Order       string    `json:"order"`
-	Sum         float64   `json:"sum"`
+	Sum         Money     `json:"sum"`
 	ProcessedAt time.Time `json:"processed_at,omitempty"`
 }
 
 type WithDrawals struct {
 	WithDrawals []WithDrawal `json:"withdrawals"`
+	Next        *Cursor      `json:"-"` // nil, если это последняя страница
 }
 
 type StorageController interface {
-	IsUserExist(login string) (bool, error)
-	IsUserValid(user UserInfo) error
-	AddUser(user UserInfo) error
-	AddOrder(login string, number string) (AddOrderReturn, error)
-	GetOrders(login string) (Orders, error)
-	GetBalance(login string) (UserBalance, error)
-	GetWithdrawals(login string) (WithDrawals, error)
-	WithdrawBalance(login string, withdrawal WithDrawal) error
-	//UpdateOrderStatus() //горутина, которая будет делать GET /api/orders/{number} для заказов, у которых статус NEW или PROCESSING
+	IsUserExist(ctx context.Context, login string) (bool, error)
+	IsUserValid(ctx context.Context, user UserInfo) (int, error) // возвращает id пользователя
+	AddUser(ctx context.Context, user UserInfo) (int, error)
+	AddOrder(ctx context.Context, userId int, number string) (AddOrderReturn, error)
+	GetOrders(ctx context.Context, userId int, filter ListFilter) (Orders, error) // от старых к новым, как требует спецификация
+	GetBalance(ctx context.Context, userId int) (UserBalance, error)
+	GetWithdrawals(ctx context.Context, userId int, filter ListFilter) (WithDrawals, error)
+	WithdrawBalance(ctx context.Context, userId int, withdrawal WithDrawal) error
+	UpdateOrderStatus(ctx context.Context, number string, status OrderStatus, accrual *Money, source string) error // ErrOrderNotFound для неизвестного заказа, ErrInvalidTransition для запрещённых переходов. При переходе в PROCESSED начисляет баллы на баланс, окончательный статус закрывает задачу проверки
+	GetOrderTimeline(ctx context.Context, userId int, number string) (OrderTimeline, error)
+	ClaimAccrualJobs(ctx context.Context, limit int, lease time.Duration) ([]AccrualJob, error) // забирает задачи, время проверки которых подошло, и откладывает их на lease
+	RetryAccrualJob(ctx context.Context, number string, attempts int, delay time.Duration, lastErr string) error
+	ReleaseAccrualJobs(ctx context.Context, numbers []string) error // возвращает в очередь задачи, по которым запрос так и не был отправлен
+	DeadAccrualJob(ctx context.Context, number string, reason string) error
+	TakeAccrualSlot(ctx context.Context) (time.Duration, error) // общий лимит запросов к системе расчёта баллов
+	PauseAccrual(ctx context.Context, pause time.Duration, interval time.Duration) error
+	GetLedger(ctx context.Context, userId int) ([]LedgerEntry, error)
+	GetStats(ctx context.Context) (Stats, error)
+	Ping(ctx context.Context) error // готовность хранилища обслуживать запросы
+	Close() error
 }
 
 type DBController struct {
-	db     *sql.DB // реализует методы StorageController'a
-	logger zerolog.Logger
+	db            *sql.DB // реализует методы StorageController'a
+	queryTimeout  time.Duration
+	schemaVersion uint // последняя миграция, вшитая в бинарник
+	logger        zerolog.Logger
 }
 
-func NewDBController(dsn string, logger zerolog.Logger) (*DBController, error) {
+// NewDBController подключается к БД. При autoMigrate схема сначала доводится до последней
+// миграции из migrations, иначе её обновляют командой migrate до запуска сервера
+func NewDBController(dsn string, migrations fs.FS, autoMigrate bool, queryTimeout time.Duration, logger zerolog.Logger) (*DBController, error) {
 
 	db, err := sql.Open("pgx", dsn)
 	if err != nil {
 		return nil, err
 	}
 
-	driver, err := postgres.WithInstance(db, &postgres.Config{})
-
+	version, err := latestVersion(migrations)
 	if err != nil {
 		return nil, err
 	}
 
-	m, err := migrate.NewWithDatabaseInstance(
-		"file://cmd/gophermart/migrations",
-		"pgx", driver)
+	if autoMigrate {
+		m, err := newMigrate(db, migrations)
+		if err != nil {
+			return nil, err
+		}
 
-	if err != nil {
-		return nil, err
-	}
-	if err := m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
-		return nil, err
+		// схему, которую уже обновила более новая реплика, не трогаем: таких миграций в бинарнике нет
+		current, _, err := m.Version()
+		if err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+			return nil, err
+		}
+
+		if errors.Is(err, migrate.ErrNilVersion) || current < version {
+			if err := m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+				return nil, err
+			}
+		}
 	}
 
 	return &DBController{
-		db:     db,
-		logger: logger,
+		db:            db,
+		queryTimeout:  queryTimeout,
+		schemaVersion: version,
+		logger:        logger,
 	}, nil
 }
 
-func (d *DBController) IsUserExist(login string) (bool, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (d *DBController) Close() error {
+	return d.db.Close()
+}
+
+// log возвращает логгер запроса из контекста, чтобы записи хранилища шли с его request_id
+func (d *DBController) log(ctx context.Context) *zerolog.Logger {
+	if l := zerolog.Ctx(ctx); l.GetLevel() != zerolog.Disabled {
+		return l
+	}
+
+	return &d.logger
+}
+
+// withTimeout ограничивает время запросов к БД, сохраняя отмену по контексту HTTP-запроса
+func (d *DBController) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, d.queryTimeout)
+}
+
+func (d *DBController) IsUserExist(ctx context.Context, login string) (bool, error) {
+	ctx, cancel := d.withTimeout(ctx)
 	defer cancel()
 
 	rows, err := d.db.QueryContext(ctx, "SELECT COUNT(*) FROM users WHERE login = $1", login)
@@ -132,117 +198,166 @@ func (d *DBController) IsUserExist(login string) (bool, error) {
 	return count == 1, nil
 }
 
-func (d *DBController) IsUserValid(user UserInfo) error {
+func (d *DBController) IsUserValid(ctx context.Context, user UserInfo) (int, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
 
-	exist, err := d.IsUserExist(user.Login)
+	var userId int
+	var password string
+	row := d.db.QueryRowContext(ctx, "SELECT id, password FROM users WHERE login = $1", user.Login)
+	err := row.Scan(&userId, &password)
 
-	if !exist || err != nil {
-		return errors.New("Problem with user!")
+	if errors.Is(err, sql.ErrNoRows) {
+		checkPassword(string(dummyHash), user.Password)
+		return 0, ErrWrongCredentials
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	rows, err := d.db.QueryContext(ctx, "SELECT login, password FROM users WHERE login = $1", user.Login)
-
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	defer rows.Close()
+	ok, needRehash := checkPassword(password, user.Password)
 
-	var userInfo UserInfo
-	rows.Next()
-	err = rows.Scan(&userInfo.Login, &userInfo.Password)
+	if !ok {
+		return 0, ErrWrongCredentials
+	}
 
-	if userInfo.Password != user.Password {
-		return errors.New("Username or password wrong!")
+	if needRehash {
+		// ошибка перехеширования не мешает пользователю войти, попробуем при следующем входе
+		if err := d.updatePassword(ctx, user); err != nil {
+			d.log(ctx).Warn().Err(err).Msg("IsUserValid: password rehash failed")
+		}
 	}
 
-	return nil
+	return userId, nil
 }
 
-func (d *DBController) AddUser(user UserInfo) error {
-	exist, err := d.IsUserExist(user.Login)
+func (d *DBController) AddUser(ctx context.Context, user UserInfo) (int, error) {
+	if err := user.Validate(); err != nil {
+		return 0, err
+	}
+
+	password, err := hashPassword(user.Password)
 
-	if exist || err != nil {
-		return errors.New("User already exist!")
+	if err != nil {
+		return 0, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := d.withTimeout(ctx)
 	defer cancel()
 
-	_, err = d.db.ExecContext(ctx, `INSERT INTO users(login, password) VALUES($1,$2)`,
-		user.Login, user.Password)
+	// пользователь и всё его состояние создаются вместе, иначе GetBalance не найдёт строку balance
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		d.log(ctx).Error().Err(err).Msg("AddUser: begin failed")
+		return 0, err
+	}
+
+	defer tx.Rollback()
+
+	// уникальность логина проверяет БД: между проверкой и вставкой мог успеть зарегистрироваться другой запрос
+	var userId int
+	row := tx.QueryRowContext(ctx, `INSERT INTO users(login, password) VALUES($1,$2)
+											ON CONFLICT (login) DO NOTHING RETURNING id`,
+		user.Login, password)
+	err = row.Scan(&userId)
+
+	if errors.Is(err, sql.ErrNoRows) || isUniqueViolation(err) {
+		return 0, ErrUserExists
+	}
 
 	if err != nil {
-		return err
+		d.log(ctx).Error().Err(err).Msg("AddUser: query failed")
+		return 0, err
 	}
 
-	return nil
+	_, err = tx.ExecContext(ctx, `INSERT INTO balance(user_id, current, withdrawn) VALUES($1, 0, 0)`, userId)
+	if err != nil {
+		d.log(ctx).Error().Err(err).Msg("AddUser: exec failed")
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		d.log(ctx).Error().Err(err).Msg("AddUser: commit failed")
+		return 0, err
+	}
+
+	return userId, nil
 }
 
-func (d *DBController) AddOrder(login string, number string) (AddOrderReturn, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	var userId int
+func (d *DBController) updatePassword(ctx context.Context, user UserInfo) error {
+	password, err := hashPassword(user.Password)
 
-	row := d.db.QueryRow("SELECT user_id FROM orders WHERE number = $1", number)
+	if err != nil {
+		return err
+	}
 
-	if row.Scan(&userId) == sql.ErrNoRows {
-		row := d.db.QueryRow("SELECT id FROM users WHERE login = $1", login)
-		err := row.Scan(&userId)
+	_, err = d.db.ExecContext(ctx, `UPDATE users SET password = $1 WHERE login = $2`, password, user.Login)
 
-		if err != nil {
-			return ERROR, err
-		}
+	return err
+}
+
+func (d *DBController) AddOrder(ctx context.Context, userId int, number string) (AddOrderReturn, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
 
-		_, err = d.db.ExecContext(ctx, `INSERT INTO orders(user_id, number, status, uploaded_at) VALUES($1,$2,$3,$4)`,
-			strconv.Itoa(userId), number, "NEW", time.Now().Format(time.RFC3339))
+	// задача проверки в системе расчёта и первая запись истории создаются тем же запросом, что и заказ
+	now := time.Now()
+	res, err := d.db.ExecContext(ctx, `WITH added AS (
+											INSERT INTO orders(user_id, number, status, uploaded_at) VALUES($1,$2,$3,$4)
+											ON CONFLICT (number) DO NOTHING RETURNING number),
+										job AS (
+											INSERT INTO accrual_jobs(order_number, state, next_attempt_at, created_at, updated_at)
+											SELECT number, $5, now(), $4, $4 FROM added)
+										INSERT INTO order_status_history(order_number, to_status, source, created_at)
+										SELECT number, $3, $6, $4 FROM added`,
+		userId, number, STATUS_NEW, now.Format(time.RFC3339), JOB_PENDING, SOURCE_UPLOAD)
 
-		if err != nil {
-			return ERROR, err
-		}
+	if err != nil {
+		d.log(ctx).Error().Err(err).Msg("AddOrder: exec failed")
+		return ERROR, err
+	}
 
+	added, err := res.RowsAffected()
+	if err != nil {
+		return ERROR, err
+	}
+
+	if added == 1 {
 		return ADDED, nil
-	} else {
+	}
 
-		var userLogin string
-		row = d.db.QueryRow("SELECT login FROM users WHERE id = $1", userId)
-		err := row.Scan(&userLogin)
+	// заказ уже загружен, выясняем кем. Заказы не удаляются, поэтому строка найдётся
+	var ownerId int
+	row := d.db.QueryRowContext(ctx, "SELECT user_id FROM orders WHERE number = $1", number)
+	err = row.Scan(&ownerId)
 
-		if err != nil {
-			return ERROR, err
-		}
-
-		if userLogin != login {
-			return ALREADY_MADE_BY_ANOTHER_USER, nil
-		}
+	if err != nil {
+		d.log(ctx).Error().Err(err).Msg("AddOrder: query failed")
+		return ERROR, err
+	}
 
+	if ownerId != userId {
+		return ALREADY_MADE_BY_ANOTHER_USER, nil
 	}
 
 	return ALREADY_MADE_BY_USER, nil
 }
 
-func (d *DBController) GetOrders(login string) (Orders, error) {
-	d.logger.Trace().Msg("GetOrders func!")
+func (d *DBController) GetOrders(ctx context.Context, userId int, filter ListFilter) (Orders, error) {
+	d.log(ctx).Trace().Msg("GetOrders func!")
 	orders := &Orders{}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := d.withTimeout(ctx)
 	defer cancel()
 
-	userId, err := d.getUserIdByLogin(login)
-	d.logger.Debug().Int("User id is ", userId).Msg("")
-
-	if err != nil {
-		d.logger.Info().Err(err).Msg("")
-		return Orders{}, err
-	}
-
-	rows, err := d.db.QueryContext(ctx, "SELECT number, status, accrual, uploaded_at from orders WHERE user_id = $1", userId)
+	query, args := filter.where("SELECT number, status, accrual, uploaded_at from orders WHERE user_id = $1",
+		[]interface{}{userId}, "uploaded_at", "number")
+	rows, err := d.db.QueryContext(ctx, query, args...)
 
 	if err != nil {
-		d.logger.Info().Err(err).Msg("")
+		d.log(ctx).Error().Err(err).Msg("GetOrders: query failed")
 		return Orders{}, err
 	}
 
@@ -252,7 +367,7 @@ func (d *DBController) GetOrders(login string) (Orders, error) {
 		var o Order
 		err = rows.Scan(&o.Number, &o.Status, &o.Accrual, &o.UploadedAt)
 		if err != nil {
-			d.logger.Info().Err(err).Msg("")
+			d.log(ctx).Error().Err(err).Msg("GetOrders: scan failed")
 			return Orders{}, err
 		}
 
@@ -261,34 +376,30 @@ func (d *DBController) GetOrders(login string) (Orders, error) {
 
 	err = rows.Err()
 	if err != nil {
-		d.logger.Info().Err(err).Msg("")
+		d.log(ctx).Error().Err(err).Msg("GetOrders: rows iteration failed")
 		return Orders{}, err
 	}
 
-	sortOrdersByTime(orders)
+	if filter.Limit > 0 && len(orders.Orders) > filter.Limit {
+		orders.Orders = orders.Orders[:filter.Limit]
+		last := orders.Orders[filter.Limit-1]
+		orders.Next = &Cursor{Time: last.UploadedAt, Number: last.Number}
+	}
 
 	return *orders, nil
 }
 
-func (d *DBController) GetBalance(login string) (UserBalance, error) {
-	d.logger.Trace().Msg("GetBalance func!")
+func (d *DBController) GetBalance(ctx context.Context, userId int) (UserBalance, error) {
+	d.log(ctx).Trace().Msg("GetBalance func!")
 	userBalance := UserBalance{}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := d.withTimeout(ctx)
 	defer cancel()
 
-	userId, err := d.getUserIdByLogin(login)
-	d.logger.Debug().Int("UserId", userId).Msg("")
-
-	if err != nil {
-		d.logger.Info().Err(err).Msg("")
-		return UserBalance{}, err
-	}
-
 	rows, err := d.db.QueryContext(ctx, "SELECT current, withdrawn FROM balance WHERE user_id = $1", userId)
 
 	if err != nil {
-		d.logger.Info().Err(err).Msg("")
+		d.log(ctx).Error().Err(err).Msg("GetBalance: query failed")
 		return UserBalance{}, err
 	}
 
@@ -298,35 +409,26 @@ func (d *DBController) GetBalance(login string) (UserBalance, error) {
 	err = rows.Scan(&userBalance.Current, &userBalance.Withdrawn)
 
 	if err != nil {
-		d.logger.Info().Err(err).Msg("")
+		d.log(ctx).Error().Err(err).Msg("GetBalance: scan failed")
 		return UserBalance{}, err
 	}
 
 	return userBalance, nil
 }
 
-func (d *DBController) GetWithdrawals(login string) (WithDrawals, error) {
-	d.logger.Trace().Msg("GetWithdrawals func!")
+func (d *DBController) GetWithdrawals(ctx context.Context, userId int, filter ListFilter) (WithDrawals, error) {
+	d.log(ctx).Trace().Msg("GetWithdrawals func!")
 	withdrawals := &WithDrawals{}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := d.withTimeout(ctx)
 	defer cancel()
 
-	userId, err := d.getUserIdByLogin(login)
-	d.logger.Debug().Int("UserId", userId).Msg("")
+	query, args := filter.where("SELECT order_number, sum, processed_at from withdrawals WHERE user_id = $1",
+		[]interface{}{userId}, "processed_at", "order_number")
+	rows, err := d.db.QueryContext(ctx, query, args...)
 
 	if err != nil {
-		d.logger.Info().Err(err).Msg("")
-		return WithDrawals{}, err
-	}
-
-	rows, err := d.db.QueryContext(ctx, `SELECT orders.number, sum, processed_at from withdrawals 
-											INNER JOIN orders ON withdrawals.order_id = orders.id
-											WHERE withdrawals.user_id = $1`,
-		userId)
-
-	if err != nil {
-		d.logger.Info().Err(err).Msg("")
+		d.log(ctx).Error().Err(err).Msg("GetWithdrawals: query failed")
 		return WithDrawals{}, err
 	}
 
@@ -336,7 +438,7 @@ func (d *DBController) GetWithdrawals(login string) (WithDrawals, error) {
 		var w WithDrawal
 		err = rows.Scan(&w.Order, &w.Sum, &w.ProcessedAt)
 		if err != nil {
-			d.logger.Info().Err(err).Msg("")
+			d.log(ctx).Error().Err(err).Msg("GetWithdrawals: scan failed")
 			return WithDrawals{}, err
 		}
 
@@ -345,133 +447,180 @@ func (d *DBController) GetWithdrawals(login string) (WithDrawals, error) {
 
 	err = rows.Err()
 	if err != nil {
-		d.logger.Info().Err(err).Msg("")
+		d.log(ctx).Error().Err(err).Msg("GetWithdrawals: rows iteration failed")
 		return WithDrawals{}, err
 	}
 
-	sortWithDrawalsByTime(withdrawals)
+	if filter.Limit > 0 && len(withdrawals.WithDrawals) > filter.Limit {
+		withdrawals.WithDrawals = withdrawals.WithDrawals[:filter.Limit]
+		last := withdrawals.WithDrawals[filter.Limit-1]
+		withdrawals.Next = &Cursor{Time: last.ProcessedAt, Number: last.Order}
+	}
 
 	return *withdrawals, nil
 }
 
-func (d *DBController) WithdrawBalance(login string, withdrawal WithDrawal) error {
-	d.logger.Trace().Msg("WithdrawBalance func!")
+func (d *DBController) WithdrawBalance(ctx context.Context, userId int, withdrawal WithDrawal) error {
+	d.log(ctx).Trace().Msg("WithdrawBalance func!")
 
-	userId, err := d.getUserIdByLogin(login)
-	d.logger.Debug().Int("UserId", userId).Msg("")
+	// отрицательное списание пополнило бы баланс
+	if withdrawal.Sum <= 0 {
+		return ErrInvalidWithdrawalSum
+	}
 
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := d.db.BeginTx(ctx, nil)
 	if err != nil {
-		d.logger.Info().Err(err).Msg("")
+		d.log(ctx).Error().Err(err).Msg("WithdrawBalance: begin transaction failed")
 		return err
 	}
+	defer tx.Rollback()
+
+	// блокируем строку баланса, чтобы конкурентные списания пользователя выполнялись по очереди
+	var current Money
+	row := tx.QueryRowContext(ctx, "SELECT current FROM balance WHERE user_id = $1 FOR UPDATE", userId)
+	err = row.Scan(&current)
 
-	userBalance, err := d.GetBalance(login)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotEnoughBalance
+	}
 
 	if err != nil {
-		d.logger.Info().Err(err).Msg("")
+		d.log(ctx).Error().Err(err).Msg("WithdrawBalance: balance lock failed")
 		return err
 	}
 
-	if userBalance.Current < withdrawal.Sum {
-		d.logger.Info().Err(ErrNotEnoughBalance).Msg(ErrNotEnoughBalance.Error())
+	// повторный запрос пользователя на ту же сумму по тому же заказу не списывает баллы второй раз,
+	// а списание другой суммы по уже оплаченному заказу - конфликт
+	var ownerId int
+	var sum Money
+	row = tx.QueryRowContext(ctx, "SELECT user_id, sum FROM withdrawals WHERE order_number = $1", withdrawal.Order)
+	err = row.Scan(&ownerId, &sum)
+
+	switch {
+	case err == nil && ownerId == userId && sum == withdrawal.Sum:
+		return nil
+	case err == nil:
+		return ErrOrderAlreadyWithdrawn
+	case !errors.Is(err, sql.ErrNoRows):
+		d.log(ctx).Error().Err(err).Msg("WithdrawBalance: query failed")
+		return err
+	}
+
+	if current < withdrawal.Sum {
+		d.log(ctx).Info().Int("user_id", userId).Msg(ErrNotEnoughBalance.Error())
 		return ErrNotEnoughBalance
 	}
 
-	// транзакция: обновление баланса пользователя и добавление записи в withdrawals
-	err = d.updateUserBalance(userId, userBalance, withdrawal)
+	_, err = tx.ExecContext(ctx, `INSERT INTO withdrawals(user_id, order_number, sum, processed_at) VALUES($1,$2,$3,$4)`,
+		userId, withdrawal.Order, withdrawal.Sum, time.Now().Format(time.RFC3339))
+
+	// номер мог занять другой пользователь в параллельной транзакции
+	if isUniqueViolation(err) {
+		return ErrOrderAlreadyWithdrawn
+	}
 
 	if err != nil {
-		d.logger.Info().Err(err).Msg("")
+		d.log(ctx).Error().Err(err).Msg("WithdrawBalance: exec failed")
 		return err
 	}
 
-	return nil
-}
-
-func (d *DBController) updateUserBalance(userId int, userBalance UserBalance, withdrawal WithDrawal) error {
-	number, err := strconv.Atoi((withdrawal.Order))
+	err = d.addLedgerEntry(ctx, tx, userId, withdrawal.Order, LEDGER_WITHDRAWAL, -withdrawal.Sum)
 
 	if err != nil {
 		return err
 	}
 
-	orderId, err := d.getOrderIdByNumber(number)
+	return tx.Commit()
+}
 
-	newBalance := UserBalance{
-		Current:   userBalance.Current - withdrawal.Sum,
-		Withdrawn: userBalance.Withdrawn + withdrawal.Sum,
-	}
+func (d *DBController) UpdateOrderStatus(ctx context.Context, number string, status OrderStatus, accrual *Money, source string) error {
+	d.log(ctx).Trace().Msg("UpdateOrderStatus func!")
 
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := d.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	tx, err := d.db.Begin()
-	if err != nil {
-		return err
+	// блокировка строки заказа упорядочивает опрос и уведомления, поэтому переход
+	// проверяется на актуальном статусе, а баллы за заказ начисляются ровно один раз
+	var userId int
+	var from OrderStatus
+	row := tx.QueryRowContext(ctx, "SELECT user_id, status FROM orders WHERE number = $1 FOR UPDATE", number)
+	err = row.Scan(&userId, &from)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrOrderNotFound
 	}
 
-	stmt, err := tx.Prepare(`UPDATE balance SET current=$1, withdrawn=$2 WHERE id=$3`)
 	if err != nil {
+		d.log(ctx).Error().Err(err).Msg("UpdateOrderStatus: query failed")
 		return err
 	}
 
-	if _, err = stmt.Exec(newBalance.Current, newBalance.Withdrawn, userId); err != nil {
-		return err
+	if from == status {
+		return nil
 	}
 
-	stmt, err = tx.Prepare(`INSERT INTO withdrawals(user_id, order_id, sum, processed_at) VALUES($1,$2,$3,$4)`)
-	if err != nil {
+	if err := Transition(from, status); err != nil {
 		return err
 	}
 
-	if _, err = stmt.Exec(userId, orderId, withdrawal.Sum, time.Now().Format(time.RFC3339)); err != nil {
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, "UPDATE orders SET status = $1, accrual = $2 WHERE number = $3", status, accrual, number)
+	if err != nil {
+		d.log(ctx).Error().Err(err).Msg("UpdateOrderStatus: exec failed")
 		return err
 	}
 
-	defer stmt.Close()
-
-	if err := tx.Commit(); err != nil {
+	_, err = tx.ExecContext(ctx, `INSERT INTO order_status_history(order_number, from_status, to_status, source, created_at)
+									VALUES($1,$2,$3,$4,$5)`,
+		number, from, status, source, now)
+	if err != nil {
+		d.log(ctx).Error().Err(err).Msg("UpdateOrderStatus: exec failed")
 		return err
 	}
 
-	return nil
-}
+	if status.Final() {
+		err = d.finishAccrualJob(ctx, tx, number)
+		if err != nil {
+			return err
+		}
+	}
 
-func (d *DBController) getOrderIdByNumber(number int) (int, error) {
-	var orderId int
-	row := d.db.QueryRow("SELECT id FROM orders WHERE number = $1", number)
-	err := row.Scan(&orderId)
+	if status == STATUS_PROCESSED && accrual != nil {
+		err = d.addLedgerEntry(ctx, tx, userId, number, LEDGER_ACCRUAL, *accrual)
 
-	if err != nil {
-		d.logger.Info().Err(err).Msg("")
-		return 0, err
+		if err != nil {
+			return err
+		}
 	}
 
-	return orderId, nil
+	return tx.Commit()
 }
 
-func (d *DBController) getUserIdByLogin(login string) (int, error) {
-	var userId int
-	row := d.db.QueryRow("SELECT id FROM users WHERE login = $1", login)
-	err := row.Scan(&userId)
-
-	if err != nil {
-		d.logger.Info().Err(err).Msg("")
-		return 0, err
-	}
-
-	return userId, nil
+// isUniqueViolation проверяет, что запрос нарушил ограничение уникальности
+func isUniqueViolation(err error) bool {
+	var pgErr pgx.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
 }
 
 func sortOrdersByTime(orders *Orders) {
 	sort.Slice(orders.Orders, func(i, j int) bool {
-		return orders.Orders[i].UploadedAt.After(orders.Orders[j].UploadedAt)
+		a, b := orders.Orders[i], orders.Orders[j]
+		return a.UploadedAt.Before(b.UploadedAt) || a.UploadedAt.Equal(b.UploadedAt) && a.Number < b.Number
 	})
 }
 
 func sortWithDrawalsByTime(withdrawals *WithDrawals) {
 	sort.Slice(withdrawals.WithDrawals, func(i, j int) bool {
-		return withdrawals.WithDrawals[i].ProcessedAt.After(withdrawals.WithDrawals[j].ProcessedAt)
+		a, b := withdrawals.WithDrawals[i], withdrawals.WithDrawals[j]
+		return a.ProcessedAt.Before(b.ProcessedAt) || a.ProcessedAt.Equal(b.ProcessedAt) && a.Order < b.Order
 	})
 }